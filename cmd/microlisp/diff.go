@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+const diffContext = 3
+
+type edit struct {
+	op   byte // ' ', '-' or '+'
+	line string
+}
+
+// Unified diff of two texts by lines, edits are found by linear space Myers algorithm
+func unifiedDiff(oldName, newName string, a, b []byte) []byte {
+	edits := diffLines(splitLines(a), splitLines(b), nil)
+	// removed lines go before added ones in every run of changes
+	for k := 0; k < len(edits); {
+		n := k
+		for n < len(edits) && edits[n].op != ' ' {
+			n++
+		}
+		slices.SortStableFunc(edits[k:n], func(a, b edit) int { return cmp.Compare(b.op, a.op) })
+		k = n + 1
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	oldLine, newLine := 1, 1 // line numbers at edits[k]
+	for k := 0; k < len(edits); {
+		if edits[k].op == ' ' {
+			oldLine++
+			newLine++
+			k++
+			continue
+		}
+		// hunk joins changes separated by at most 2*diffContext unchanged lines
+		start := max(k-diffContext, 0)
+		last := k
+		for n := k + 1; n < len(edits) && n-last <= 2*diffContext+1; n++ {
+			if edits[n].op != ' ' {
+				last = n
+			}
+		}
+		end := min(last+1+diffContext, len(edits))
+		hunkOld, hunkNew := oldLine-(k-start), newLine-(k-start)
+		var oldCount, newCount int
+		var body bytes.Buffer
+		for _, e := range edits[start:end] {
+			body.WriteByte(e.op)
+			body.WriteString(e.line)
+			if e.op != '+' {
+				oldCount++
+			}
+			if e.op != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(hunkOld, oldCount), hunkRange(hunkNew, newCount))
+		out.Write(body.Bytes())
+		for _, e := range edits[k:end] {
+			if e.op != '+' {
+				oldLine++
+			}
+			if e.op != '-' {
+				newLine++
+			}
+		}
+		k = end
+	}
+	return out.Bytes()
+}
+
+// Append edits which turn x into y to edits
+func diffLines(x, y []string, edits []edit) []edit {
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		edits = append(edits, edit{' ', x[prefix]})
+		prefix++
+	}
+	x, y = x[prefix:], y[prefix:]
+	suffix := 0
+	for suffix < len(x) && suffix < len(y) && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+	common := x[len(x)-suffix:]
+	x, y = x[:len(x)-suffix], y[:len(y)-suffix]
+	switch {
+	case len(x) == 0:
+		for _, line := range y {
+			edits = append(edits, edit{'+', line})
+		}
+	case len(y) == 0:
+		for _, line := range x {
+			edits = append(edits, edit{'-', line})
+		}
+	default:
+		// both parts differ at their ends, so the shortest edit script has at least 2 edits
+		// and both halves around the middle snake are smaller
+		xs, ys, xe, ye := middleSnake(x, y)
+		edits = diffLines(x[:xs], y[:ys], edits)
+		for _, line := range x[xs:xe] {
+			edits = append(edits, edit{' ', line})
+		}
+		edits = diffLines(x[xe:], y[ye:], edits)
+	}
+	for _, line := range common {
+		edits = append(edits, edit{' ', line})
+	}
+	return edits
+}
+
+// Middle snake of the shortest edit script of x and y: x[xs:xe] equals y[ys:ye],
+// forward and backward searches meet on it (Myers, "An O(ND) Difference Algorithm")
+func middleSnake(x, y []string) (xs, ys, xe, ye int) {
+	n, m := len(x), len(y)
+	delta := n - m
+	limit := (n + m + 1) / 2
+	// vf[k] is the furthest x on diagonal x-y=k from the start,
+	// vb[k] is the furthest distance from the end on diagonal (n-x)-(m-y)=k
+	off := limit + 1
+	vf := make([]int, 2*off+1)
+	vb := make([]int, 2*off+1)
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			i := vf[off+k+1]
+			if k != -d && (k == d || vf[off+k-1] >= vf[off+k+1]) {
+				i = vf[off+k-1] + 1
+			}
+			j := i - k
+			i0, j0 := i, j
+			for i < n && j < m && x[i] == y[j] {
+				i++
+				j++
+			}
+			vf[off+k] = i
+			if kb := delta - k; delta%2 != 0 && kb >= -(d-1) && kb <= d-1 && i+vb[off+kb] >= n {
+				return i0, j0, i, j
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			u := vb[off+k+1]
+			if k != -d && (k == d || vb[off+k-1] >= vb[off+k+1]) {
+				u = vb[off+k-1] + 1
+			}
+			v := u - k
+			u0, v0 := u, v
+			for u < n && v < m && x[n-1-u] == y[m-1-v] {
+				u++
+				v++
+			}
+			vb[off+k] = u
+			if kf := delta - k; delta%2 == 0 && kf >= -d && kf <= d && vf[off+kf]+u >= n {
+				return n - u, m - v, n - u0, m - v0
+			}
+		}
+	}
+	panic("diff: no middle snake")
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// Lines with their end of line, the last one gets a marker if it has none
+func splitLines(s []byte) []string {
+	var res []string
+	for len(s) > 0 {
+		i := bytes.IndexByte(s, '\n')
+		if i < 0 {
+			res = append(res, string(s)+"\n\\ No newline at end of file\n")
+			break
+		}
+		res = append(res, string(s[:i+1]))
+		s = s[i+1:]
+	}
+	return res
+}
@@ -0,0 +1,99 @@
+// Command microlisp is a tool for microlisp rule sources.
+//
+// Usage:
+//
+//	microlisp fmt [-w] [-d] [-width n] [path ...]
+//
+// fmt re-indents rule files, with no path it formats standard input.
+//
+//	-w      write result to the source file instead of standard output
+//	-d      print diff instead of formatted source
+//	-width  line width to fit expressions into (default 80)
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	microlisp "github.com/mardongvo/microlisp-go"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: microlisp fmt [-w] [-d] [-width n] [path ...]\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "fmt" {
+		usage()
+	}
+	os.Exit(fmtMain(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func fmtMain(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	write := flags.Bool("w", false, "write result to the source file instead of standard output")
+	diff := flags.Bool("d", false, "print diff instead of formatted source")
+	width := flags.Int("width", 80, "line width to fit expressions into")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		if *write {
+			fmt.Fprintf(stderr, "microlisp fmt: cannot use -w with standard input\n")
+			return 2
+		}
+		src, err := io.ReadAll(stdin)
+		if err == nil {
+			err = formatFile("<standard input>", src, false, *diff, *width, stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 1
+		}
+		return 0
+	}
+	res := 0
+	for _, path := range flags.Args() {
+		src, err := os.ReadFile(path)
+		if err == nil {
+			err = formatFile(path, src, *write, *diff, *width, stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			res = 1
+		}
+	}
+	return res
+}
+
+func formatFile(path string, src []byte, write, diff bool, width int, out io.Writer) error {
+	program, err := microlisp.ParseProgram(string(src))
+	if err != nil {
+		return fmt.Errorf("%s:%v", path, err)
+	}
+	res := src
+	if len(program) > 0 { // comments only source is kept as is
+		res = []byte(microlisp.PrettyProgram(program, width))
+	}
+	if diff {
+		if !bytes.Equal(src, res) {
+			fmt.Fprintf(out, "diff %s %s.formatted\n", path, path)
+			out.Write(unifiedDiff(path, path+".formatted", src, res))
+		}
+	} else if !write {
+		out.Write(res)
+	}
+	if write && !bytes.Equal(src, res) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, res, info.Mode().Perm())
+	}
+	return nil
+}
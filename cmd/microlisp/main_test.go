@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFmt(t *testing.T) {
+	var tests = []struct {
+		args []string
+		inp  string
+		code int
+		outp string
+	}{
+		{[]string{}, "(and !a\n (or !b !c))", 0, "(and !a (or !b !c))\n"},
+		{[]string{"-width", "13"}, "(and !a (or !b !c))", 0, "(and\n  !a\n  (or !b !c))\n"},
+		{[]string{"-d"}, "(a)\n(b   c)\n", 0,
+			"diff <standard input> <standard input>.formatted\n--- <standard input>\n+++ <standard input>.formatted\n" +
+				"@@ -1,2 +1,3 @@\n (a)\n-(b   c)\n+\n+(b c)\n"},
+		{[]string{"-d"}, "(a)\n\n(b c)\n", 0, ""},
+		{[]string{}, "; only comment", 0, "; only comment"},
+		{[]string{}, "(a", 1, ""},
+		{[]string{"-w"}, "(a)", 2, ""},
+		{[]string{"-d", "-width", "120"}, "(f 3.14159265358979 12345678901234567890 90m 2024-01-01 [1 2] {a:1 \"b c\":0.25} 0.10d)\n",
+			0, ""},
+	}
+	for _, test := range tests {
+		var out, errout bytes.Buffer
+		code := fmtMain(test.args, strings.NewReader(test.inp), &out, &errout)
+		if code != test.code || out.String() != test.outp {
+			t.Errorf("fmt %v \"%v\" gives %d \"%v\" (%v), expected %d \"%v\"",
+				test.args, test.inp, code, out.String(), errout.String(), test.code, test.outp)
+		}
+	}
+}
+
+func TestFmtWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rule.ml")
+	os.WriteFile(path, []byte("(and  !a\n!b)"), 0644)
+	var out, errout bytes.Buffer
+	if code := fmtMain([]string{"-w", path}, nil, &out, &errout); code != 0 || out.Len() != 0 {
+		t.Errorf("fmt -w gives %d \"%v\" (%v)", code, out.String(), errout.String())
+	}
+	if src, _ := os.ReadFile(path); string(src) != "(and !a !b)\n" {
+		t.Errorf("fmt -w writes \"%s\"", src)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "1\n2x\n3\n4\n5\n6\n7\n8\n9\n10\n11x\n12\n"
+	expected := "--- a\n+++ b\n@@ -1,5 +1,5 @@\n 1\n-2\n+2x\n 3\n 4\n 5\n@@ -8,5 +8,5 @@\n 8\n 9\n 10\n-11\n+11x\n 12\n"
+	if x := string(unifiedDiff("a", "b", []byte(a), []byte(b))); x != expected {
+		t.Errorf("unifiedDiff gives \"%v\", expected \"%v\"", x, expected)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for n := 0; n < 500; n++ {
+		x := make([]string, rnd.Intn(12))
+		y := make([]string, rnd.Intn(12))
+		for i := range x {
+			x[i] = string(rune('a' + rnd.Intn(3)))
+		}
+		for i := range y {
+			y[i] = string(rune('a' + rnd.Intn(3)))
+		}
+		// lcs[i][j] is the length of common subsequence of x[i:] and y[j:]
+		lcs := make([][]int, len(x)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(y)+1)
+		}
+		for i := len(x) - 1; i >= 0; i-- {
+			for j := len(y) - 1; j >= 0; j-- {
+				if x[i] == y[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		var a, b []string
+		same := 0
+		for _, e := range diffLines(x, y, nil) {
+			if e.op != '+' {
+				a = append(a, e.line)
+			}
+			if e.op != '-' {
+				b = append(b, e.line)
+			}
+			if e.op == ' ' {
+				same++
+			}
+		}
+		if !slices.Equal(a, x) || !slices.Equal(b, y) || same != lcs[0][0] {
+			t.Fatalf("diffLines %v %v gives %d common lines, expected %d", x, y, same, lcs[0][0])
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package microlisp
 
 import (
+	"errors"
 	"fmt"
-	"regexp"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
 )
 
 // fuzzy logic support
@@ -13,6 +17,16 @@ type FuzzyElement struct {
 
 type FuzzySetType []FuzzyElement
 
+// List of evaluated values, unlike expression it is never evaluated as a function call
+type ListType []Statement
+
+// Map of evaluated values by string keys
+type MapType map[string]Statement
+
+// Absence of value, like optional environment key which is not set or JSON null.
+// logic functions take nil as false, fuzzy functions as 0.0, other functions give error
+type NilType struct{}
+
 // types declaration
 type StatementType uint8
 
@@ -24,12 +38,35 @@ const (
 	STFloatArray
 	STBool
 	STFuzzy
+	STList
+	STMap
+	STNil
+	STTime
+	STDuration
+	STDecimal
+	STFunction
 	STError
 	STUnknown
 )
 
 type Statement struct {
-	Value interface{}
+	Value  interface{}
+	Source *SourceInfo // nil if statement is not read from source
+}
+
+// Details of statement which come from source text, they are shared by copies of the statement
+type SourceInfo struct {
+	Quoted   bool      // string literal written in double quotes: never converted, never an `env' reference
+	Comments []Comment // source comments before the statement
+	Trailing []Comment // source comments after the statement up to `)' or end of source
+	Text     string    // source text of number, time, duration literal, float array or fuzzy set, Pretty keeps it
+	Pos      Position  // where the statement starts in source
+}
+
+// Source comment, `; line' or `#| block |#', text is kept verbatim
+type Comment struct {
+	Text   string
+	Inline bool // written on the line where the preceding statement ends
 }
 
 type FunctionMap map[string]FunctionHandler
@@ -47,58 +84,200 @@ type tokenType uint8
 type Token struct {
 	typ tokenType
 	val string
+	pos Position
+	end Position // position after the token
 }
 
-type Pattern struct {
-	typ    tokenType
-	regexp *regexp.Regexp
+// Position in source: byte offset, 1-based line and column (column counts runes)
+type Position struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Position after text starting at p
+func (p Position) advance(text string) Position {
+	for _, r := range text {
+		if r == '\n' {
+			p.Line++
+			p.Column = 1
+		} else {
+			p.Column++
+		}
+	}
+	p.Offset += len(text)
+	return p
 }
 
 const (
-	whitespaceToken tokenType = iota
-	atomToken
+	atomToken tokenType = iota
 	openToken
 	closeToken
+	stringToken
+	commentToken
+	openBracketToken  // `[' of float array literal
+	closeBracketToken // `]'
+	openBraceToken    // `{' of fuzzy set literal
+	closeBraceToken   // `}'
+	quoteToken        // ' ` , ,@ before a form, val is name of the form: quote, quasiquote, unquote, unquote-splicing
 )
 
-func patterns() []Pattern {
-	return []Pattern{
-		{whitespaceToken, regexp.MustCompile(`^\s+`)},
-		{atomToken, regexp.MustCompile(`^([^\(\)\s]+)`)},
-		{openToken, regexp.MustCompile(`^(\()`)},
-		{closeToken, regexp.MustCompile(`^(\))`)},
+var ErrorUnterminatedString = fmt.Errorf("unterminated string literal")
+var ErrorInvalidEscape = fmt.Errorf("invalid escape sequence in string literal")
+var ErrorUnterminatedComment = fmt.Errorf("unterminated block comment")
+
+func splitToTokens(program string) (tokens Tokens, err error) {
+	s := newScanner(strings.NewReader(program))
+	for {
+		tok, err := s.scan()
+		if err == io.EOF {
+			return tokens, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
 	}
 }
 
-func splitToTokens(program string) (tokens Tokens) {
-	for pos := 0; pos < len(program); {
-		for _, pattern := range patterns() {
-			if matches := pattern.regexp.FindStringSubmatch(program[pos:]); matches != nil {
-				if (len(matches) > 1) && (pattern.typ != whitespaceToken) {
-					tokens = append(tokens, &Token{pattern.typ, matches[1]})
+// Decode escape sequences of a string literal body: \" \\ \n \t \r \uXXXX
+func unescapeString(s string) (string, error) {
+	if !strings.ContainsRune(s, '\\') {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return "", ErrorInvalidEscape
+		}
+		switch s[i] {
+		case '"', '\\', '/':
+			b.WriteByte(s[i])
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'u':
+			r, ok := hexRune(s[i+1:])
+			if !ok {
+				return "", ErrorInvalidEscape
+			}
+			i += 4
+			// surrogate pair \uD83D\uDE00
+			if utf16.IsSurrogate(r) && strings.HasPrefix(s[i+1:], "\\u") {
+				if r2, ok := hexRune(s[i+3:]); ok {
+					if dec := utf16.DecodeRune(r, r2); dec != '\uFFFD' {
+						r = dec
+						i += 6
+					}
 				}
-				pos = pos + len(matches[0])
-				break
 			}
+			b.WriteRune(r)
+		default:
+			return "", ErrorInvalidEscape
 		}
 	}
-	return
+	return b.String(), nil
+}
+
+func hexRune(s string) (rune, bool) {
+	if len(s) < 4 {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(s[:4], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	return rune(v), true
 }
 
 // *AST
 var ErrorEndOfExpression = fmt.Errorf("unexprected end of expression")
 var ErrorExpectOpen = fmt.Errorf("expected opening parenthesis")
 var ErrorTooManyTokens = fmt.Errorf("too many tokens")
+var ErrorUnexpectedClose = fmt.Errorf("unexpected closing bracket")
+var ErrorInvalidLiteral = fmt.Errorf("invalid float array or fuzzy set literal")
+
+// Parse failure with its place in source, errors.Is matches the Error* sentinels
+type ParseError struct {
+	Err   error
+	Pos   Position
+	Line  string // source line of Pos
+	first int    // column of Line start when it is only a tail of a long line
+}
+
+func newParseError(program string, err error, pos Position) *ParseError {
+	start := strings.LastIndexByte(program[:pos.Offset], '\n') + 1
+	end := strings.IndexByte(program[pos.Offset:], '\n')
+	if end < 0 {
+		end = len(program)
+	} else {
+		end += pos.Offset
+	}
+	return &ParseError{Err: err, Pos: pos, Line: program[start:end]}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %s\n%s", e.Pos, e.Err, e.Snippet())
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Source line with a caret under the error column
+func (e *ParseError) Snippet() string {
+	var caret strings.Builder
+	col := max(e.first, 1)
+	for _, r := range e.Line {
+		if col >= e.Pos.Column {
+			break
+		}
+		if r == '\t' {
+			caret.WriteRune('\t')
+		} else {
+			caret.WriteRune(' ')
+		}
+		col++
+	}
+	return e.Line + "\n" + caret.String() + "^"
+}
+
+// Position of tokens[idx], end of program if idx is out of range
+func tokenPosition(program string, tokens Tokens, idx int) Position {
+	if idx < len(tokens) {
+		return tokens[idx].pos
+	}
+	return Position{Line: 1, Column: 1}.advance(program)
+}
 
 // we expect only
 // 1. one atom
 // 2. s-expression
-func buildAST(tokens Tokens, startpos int) (Statement, int, error) {
+// comments are attached to the following statement, or to the preceding one
+// when nothing follows them before the closing parenthesis
+func buildAST(tokens Tokens, startpos int, opts ParseOptions) (Statement, int, error) {
 	var expression = make([]Statement, 0)
+	var comments []Comment
 	pos := startpos
-	if (tokens[pos].typ == atomToken) && (len(tokens) == 1) {
-		return NewStatement(tokens[pos].val, true), pos, nil
-	}
 	if tokens[pos].typ == openToken {
 		pos++
 		if pos >= len(tokens) {
@@ -106,18 +285,56 @@ func buildAST(tokens Tokens, startpos int) (Statement, int, error) {
 		}
 		isFirstToken := true
 		for pos < len(tokens) && (tokens[pos].typ != closeToken) {
+			if tokens[pos].typ == commentToken && len(comments) == 0 && len(expression) > 0 &&
+				isInlineComment(tokens, pos) {
+				expression[len(expression)-1].addTrailing([]Comment{{Text: tokens[pos].val, Inline: true}})
+				pos++
+				continue
+			}
+			if tokens[pos].typ == commentToken {
+				comments = append(comments, Comment{Text: tokens[pos].val})
+				pos++
+				continue
+			}
+			if tokens[pos].typ == closeBracketToken || tokens[pos].typ == closeBraceToken {
+				return Statement{}, pos, ErrorUnexpectedClose
+			}
 			if tokens[pos].typ == atomToken {
-				expression = append(expression,
-					NewStatement(tokens[pos].val, !isFirstToken)) // do not convert first token (function name)
+				stm := opts.atomStatement(tokens[pos].val, !isFirstToken) // do not convert first token (function name)
+				stm.setPos(tokens[pos].pos)
+				expression = append(expression, stm)
+			}
+			if tokens[pos].typ == stringToken {
+				stm := NewQuotedStringStatement(tokens[pos].val)
+				stm.setPos(tokens[pos].pos)
+				expression = append(expression, stm)
 			}
 			if tokens[pos].typ == openToken { //function name may be s-expression that return string
-				stm, newpos, err := buildAST(tokens, pos)
+				stm, newpos, err := buildAST(tokens, pos, opts)
 				if err != nil {
 					return Statement{}, newpos, err
 				}
 				expression = append(expression, stm)
 				pos = newpos
 			}
+			if tokens[pos].typ == quoteToken {
+				stm, newpos, err := formFromTokens(tokens, pos, opts)
+				if err != nil {
+					return Statement{}, newpos, err
+				}
+				expression = append(expression, stm)
+				pos = newpos
+			}
+			if tokens[pos].typ == openBracketToken || tokens[pos].typ == openBraceToken {
+				stm, newpos, err := buildLiteral(tokens, pos, opts)
+				if err != nil {
+					return Statement{}, newpos, err
+				}
+				expression = append(expression, stm)
+				pos = newpos
+			}
+			expression[len(expression)-1].addComments(comments)
+			comments = nil
 			isFirstToken = false
 			pos++
 		}
@@ -127,62 +344,474 @@ func buildAST(tokens Tokens, startpos int) (Statement, int, error) {
 	} else {
 		return Statement{}, pos, ErrorExpectOpen
 	}
-	return NewExpressionStatement(expression), pos, nil
+	res := NewExpressionStatement(expression)
+	res.setPos(tokens[startpos].pos)
+	if len(comments) > 0 {
+		if len(expression) > 0 {
+			expression[len(expression)-1].addTrailing(comments)
+		} else {
+			res.addTrailing(comments)
+		}
+	}
+	return res, pos, nil
+}
+
+// Float array `[0.1 0.2 3]' or fuzzy set `{low:0.2 mid: 0.5 "New York":0.3}' starting at tokens[startpos]
+// comments inside literals are kept as trailing comments of the literal
+func buildLiteral(tokens Tokens, startpos int, opts ParseOptions) (Statement, int, error) {
+	var res Statement
+	var comments []Comment
+	var texts []string // source text of elements
+	pos := startpos + 1
+	next := func() *Token { // next token except comments, nil at the end
+		if len(comments) == 0 && isInlineComment(tokens, pos) {
+			comments = append(comments, Comment{Text: tokens[pos].val, Inline: true})
+			pos++
+		}
+		var c []Comment
+		c, pos = collectComments(tokens, pos)
+		comments = append(comments, c...)
+		if pos >= len(tokens) {
+			return nil
+		}
+		return tokens[pos]
+	}
+	if tokens[startpos].typ == openBracketToken {
+		arr := make([]float32, 0)
+		for tok := next(); tok == nil || tok.typ != closeBracketToken; tok = next() {
+			if tok == nil {
+				return Statement{}, pos, ErrorEndOfExpression
+			}
+			f, ok := literalNumber(tok.val)
+			if tok.typ != atomToken || !ok {
+				return Statement{}, pos, ErrorInvalidLiteral
+			}
+			arr = append(arr, f)
+			texts = append(texts, tok.val)
+			pos++
+		}
+		res = NewFloatArrayStatement(arr)
+		res.editSource(func(info *SourceInfo) { info.Text = "[" + strings.Join(texts, " ") + "]" })
+	} else {
+		set := make(FuzzySetType, 0)
+		for tok := next(); tok == nil || tok.typ != closeBraceToken; tok = next() {
+			if tok == nil {
+				return Statement{}, pos, ErrorEndOfExpression
+			}
+			var key Statement
+			var keyText, value string // value is atom text after `:'
+			keyPos := tok.pos
+			switch tok.typ {
+			case atomToken:
+				i := strings.LastIndexByte(tok.val, ':')
+				if i <= 0 {
+					return Statement{}, pos, ErrorInvalidLiteral
+				}
+				key, keyText, value = opts.atomStatement(tok.val[:i], true), tok.val[:i], tok.val[i+1:]
+			case stringToken:
+				key, keyText = NewQuotedStringStatement(tok.val), QuoteString(tok.val)
+				pos++
+				if tok = next(); tok == nil {
+					return Statement{}, pos, ErrorEndOfExpression
+				}
+				if tok.typ != atomToken || tok.val[0] != ':' {
+					return Statement{}, pos, ErrorInvalidLiteral
+				}
+				value = tok.val[1:]
+			default:
+				return Statement{}, pos, ErrorInvalidLiteral
+			}
+			pos++
+			if value == "" { // `key: 0.5'
+				if tok = next(); tok == nil {
+					return Statement{}, pos, ErrorEndOfExpression
+				}
+				if tok.typ != atomToken {
+					return Statement{}, pos, ErrorInvalidLiteral
+				}
+				value = tok.val
+				pos++
+			}
+			f, ok := literalNumber(value)
+			if !ok {
+				return Statement{}, pos - 1, ErrorInvalidLiteral
+			}
+			key.setPos(keyPos)
+			set = append(set, FuzzyElement{key, f})
+			texts = append(texts, keyText+":"+value)
+		}
+		res = NewFuzzyStatement(set)
+		res.editSource(func(info *SourceInfo) { info.Text = "{" + strings.Join(texts, " ") + "}" })
+	}
+	res.setPos(tokens[startpos].pos)
+	res.addTrailing(comments)
+	return res, pos, nil
+}
+
+// Statement of atom, converted value keeps its source text
+func (opts ParseOptions) atomStatement(text string, tryConvert bool) Statement {
+	stm := opts.NewStatement(text, tryConvert)
+	if stm.Type() != STString {
+		stm.editSource(func(info *SourceInfo) { info.Text = text })
+	}
+	return stm
+}
+
+func literalNumber(s string) (float32, bool) {
+	switch v := NewStatement(s, true); v.Type() {
+	case STInt, STFloat:
+		return float32(v.ValueFloat()), true
+	}
+	return 0, false
+}
+
+// Is tokens[pos] a comment on the line where the previous token ends
+func isInlineComment(tokens Tokens, pos int) bool {
+	return pos > 0 && pos < len(tokens) && tokens[pos].typ == commentToken && tokens[pos].pos.Line == tokens[pos-1].end.Line
 }
 
+// Skip comment tokens starting from pos
+func collectComments(tokens Tokens, pos int) ([]Comment, int) {
+	var comments []Comment
+	for ; pos < len(tokens) && tokens[pos].typ == commentToken; pos++ {
+		comments = append(comments, Comment{Text: tokens[pos].val})
+	}
+	return comments, pos
+}
+
+// Build next top-level form (atom or s-expression) starting at tokens[pos]
+// returns index of the last token of the form, or of the failed one
+func formFromTokens(tokens Tokens, pos int, opts ParseOptions) (Statement, int, error) {
+	var stm Statement
+	var err error
+	leading, pos := collectComments(tokens, pos)
+	if pos >= len(tokens) {
+		return Statement{}, pos, ErrorEndOfExpression
+	}
+	tok := tokens[pos]
+	if tok.typ == atomToken || tok.typ == stringToken {
+		if tok.typ == atomToken {
+			stm = opts.atomStatement(tok.val, true)
+		} else {
+			stm = NewQuotedStringStatement(tok.val)
+		}
+		stm.setPos(tok.pos)
+	} else if tok.typ == openBracketToken || tok.typ == openBraceToken {
+		if stm, pos, err = buildLiteral(tokens, pos, opts); err != nil {
+			return Statement{}, pos, err
+		}
+	} else if tok.typ == quoteToken { // 'x is (quote x), `x is (quasiquote x), ,x and ,@x are unquotes
+		var form Statement
+		if form, pos, err = formFromTokens(tokens, pos+1, opts); err != nil {
+			return Statement{}, pos, err
+		}
+		head := NewStringStatement(tok.val)
+		head.setPos(tok.pos)
+		stm = NewExpressionStatement([]Statement{head, form})
+		stm.setPos(tok.pos)
+	} else if stm, pos, err = buildAST(tokens, pos, opts); err != nil {
+		return Statement{}, pos, err
+	}
+	stm.addComments(leading)
+	for ; isInlineComment(tokens, pos+1); pos++ {
+		stm.addTrailing([]Comment{{Text: tokens[pos+1].val, Inline: true}})
+	}
+	return stm, pos, nil
+}
+
+// Parse next top-level form, returns position after the form
+func parseForm(program string, tokens Tokens, pos int, opts ParseOptions) (Statement, int, error) {
+	stm, pos, err := formFromTokens(tokens, pos, opts)
+	if err != nil {
+		return Statement{}, pos, newParseError(program, err, tokenPosition(program, tokens, pos))
+	}
+	return stm, pos + 1, nil
+}
+
+// Parser settings
+type ParseOptions struct {
+	Float64 bool // read float atoms as float64 instead of float32
+}
+
+// Parse exactly one form: s-expression or single atom
 func Parse(program string) (Statement, error) {
-	tokens := splitToTokens(program)
-	stm, endpos, err := buildAST(tokens, 0)
+	return ParseWithOptions(program, ParseOptions{})
+}
+
+func ParseWithOptions(program string, opts ParseOptions) (Statement, error) {
+	tokens, err := splitToTokens(program)
 	if err != nil {
 		return Statement{}, err
 	}
-	if endpos != len(tokens)-1 {
-		return Statement{}, ErrorTooManyTokens
+	_, startpos := collectComments(tokens, 0)
+	if startpos < len(tokens) && (tokens[startpos].typ == atomToken || tokens[startpos].typ == stringToken) &&
+		hasMoreTokens(tokens, startpos+1) {
+		return Statement{}, newParseError(program, ErrorExpectOpen, tokens[startpos].pos)
 	}
+	stm, endpos, err := parseForm(program, tokens, 0, opts)
+	if err != nil {
+		return Statement{}, err
+	}
+	trailing, endpos := collectComments(tokens, endpos)
+	if endpos != len(tokens) {
+		return Statement{}, newParseError(program, ErrorTooManyTokens, tokens[endpos].pos)
+	}
+	stm.addTrailing(trailing)
 	return stm, nil
 }
 
+// Parse sequence of top-level forms, e.g. definitions followed by a decision expression
+// comments after the last form are attached to it
+func ParseProgram(program string) ([]Statement, error) {
+	return ParseProgramWithOptions(program, ParseOptions{})
+}
+
+func ParseProgramWithOptions(program string, opts ParseOptions) ([]Statement, error) {
+	var stm Statement
+	tokens, err := splitToTokens(program)
+	if err != nil {
+		return nil, err
+	}
+	forms := make([]Statement, 0)
+	pos := 0
+	for hasMoreTokens(tokens, pos) {
+		if stm, pos, err = parseForm(program, tokens, pos, opts); err != nil {
+			return nil, err
+		}
+		forms = append(forms, stm)
+	}
+	if trailing, _ := collectComments(tokens, pos); len(forms) > 0 {
+		forms[len(forms)-1].addTrailing(trailing)
+	}
+	return forms, nil
+}
+
+// Is there anything but comments from pos
+func hasMoreTokens(tokens Tokens, pos int) bool {
+	_, pos = collectComments(tokens, pos)
+	return pos < len(tokens)
+}
+
 //***<--Parse
 
 // `env' function
+// key is a path through nested maps and lists, see Environment.GetPath
+// (env key default) gives evaluated default if key is not found or is not a valid path
 func GetFromEnv(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
-	var key Statement
-	if len(expr) != 1 {
-		return NewErrorStatement(fmt.Errorf("function `env' expect 1 param"))
+	if len(expr) != 1 && len(expr) != 2 {
+		return NewErrorStatement(fmt.Errorf("function `env' expect 1 or 2 param"))
 	}
-	if expr[0].Type() == STExpression {
-		key = Eval(funcs, env, &expr[0])
-	} else {
-		key = expr[0]
+	key := envKey(funcs, env, &expr[0])
+	if key.Type() == STError {
+		return key
 	}
 	if key.Type() != STString {
 		return NewErrorStatement(fmt.Errorf("function `env' expect 1 param is string"))
 	}
-	if val, ok := (*env).Get(key.ValueString()); ok {
+	val, err := (*env).GetPath(key.ValueString())
+	if isKeyMissing(err) && len(expr) == 2 {
+		return Eval(funcs, env, &expr[1])
+	}
+	if err != nil {
+		return NewErrorStatement(err)
+	}
+	return val
+}
+
+// `has-env' function, true if key is found, false for invalid path
+func HasEnv(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+	if len(expr) != 1 {
+		return NewErrorStatement(fmt.Errorf("function `has-env' expect 1 param"))
+	}
+	key := envKey(funcs, env, &expr[0])
+	if key.Type() == STError {
+		return key
+	}
+	if key.Type() != STString {
+		return NewErrorStatement(fmt.Errorf("function `has-env' expect 1 param is string"))
+	}
+	_, err := (*env).GetPath(key.ValueString())
+	if err != nil && !isKeyMissing(err) {
+		return NewErrorStatement(err)
+	}
+	return NewBoolStatement(err == nil)
+}
+
+// Is it error of GetPath for key which is not in environment:
+// not found, or not found as a whole and not valid as a path
+func isKeyMissing(err error) bool {
+	return errors.Is(err, ErrorKeyNotFound) || errors.Is(err, ErrorInvalidPath)
+}
+
+// Key is evaluated if it is an expression, taken as is otherwise
+func envKey(funcs *FunctionMap, env *Environment, expr *Statement) Statement {
+	if expr.Type() == STExpression {
+		return Eval(funcs, env, expr)
+	}
+	return *expr
+}
+
+// `!key?' form, nil if key is not found
+func getOptionalFromEnv(env *Environment, key string) Statement {
+	if val, ok := (*env).Get(key + "?"); ok {
 		return val
 	}
-	return NewErrorStatement(fmt.Errorf("environment key `%s' not found", key.ValueString()))
+	val, err := (*env).GetPath(key)
+	if isKeyMissing(err) {
+		return NewNilStatement()
+	}
+	if err != nil {
+		return NewErrorStatement(err)
+	}
+	return val
+}
+
+// `let' and `let*' forms: (let ((name value)...) body...)
+// values are bound in a child scope visible through `env' and `!name' in body,
+// `let' evaluates all values in the outer scope, `let*' sees previous bindings.
+// body forms are evaluated in order, result is the last one
+func Let(funcs *FunctionMap, env *Environment, expr []Statement, sequential bool) Statement {
+	name := "let"
+	if sequential {
+		name = "let*"
+	}
+	if len(expr) < 2 {
+		return NewErrorStatement(fmt.Errorf("function `%s' required bindings and body", name))
+	}
+	if expr[0].Type() != STExpression {
+		return NewErrorStatement(fmt.Errorf("function `%s' expect list of bindings", name))
+	}
+	scope, errStm := bindLet(funcs, env, name, expr[0].ValueExpression(), sequential)
+	if errStm != nil {
+		return *errStm
+	}
+	return EvalProgram(funcs, &scope, expr[1:])
+}
+
+// Child scope of env with (name value) bindings of `let' or `let*', returns error statement on failure
+func bindLet(funcs *FunctionMap, env *Environment, name string, bindings []Statement, sequential bool) (Environment, *Statement) {
+	scope := (*env).Child()
+	for _, b := range bindings {
+		pair := b.ValueExpression()
+		if b.Type() != STExpression || len(pair) != 2 || !isBindingName(pair[0]) {
+			err := NewErrorStatement(fmt.Errorf("function `%s' expect (name value) binding", name))
+			return nil, &err
+		}
+		from := env
+		if sequential {
+			from = &scope
+		}
+		v := Eval(funcs, from, &pair[1])
+		if v.Type() == STError {
+			return nil, &v
+		}
+		scope[pair[0].ValueString()] = v
+	}
+	return scope, nil
+}
+
+// Name of local binding is an unquoted atom, not an `env' reference
+func isBindingName(s Statement) bool {
+	return s.Type() == STString && !s.Quoted() && s.ValueString() != "" && !strings.HasPrefix(s.ValueString(), "!") &&
+		!isReservedKey(s.ValueString())
 }
 
 // Eval
+// error results get position of the innermost expression produced them
 func Eval(funcs *FunctionMap, env *Environment, expr *Statement) Statement {
+	res := eval(funcs, env, expr)
+	if res.Type() == STError && !res.Pos().IsValid() && expr.Pos().IsValid() {
+		res.setPos(expr.Pos())
+	}
+	return res
+}
+
+func eval(funcs *FunctionMap, env *Environment, expr *Statement) Statement {
 	if expr.Type() == STExpression {
 		e := expr.ValueExpression()
 		if len(e) == 0 {
 			return NewErrorStatement(fmt.Errorf("expression without function name"))
 		}
-		if e[0].ValueString() == "env" {
+		head := e[0]
+		if head.Type() == STExpression { // ((lambda (x) ...) 1) or expression giving function name
+			if head = Eval(funcs, env, &head); head.Type() == STError {
+				return head
+			}
+		}
+		if head.Type() == STFunction {
+			return head.ValueFunction().Call(funcs, env, e[1:])
+		}
+		name := head.ValueString()
+		if name == "env" {
 			return GetFromEnv(funcs, env, e[1:])
 		}
-		if fhandler, ok := (*funcs)[e[0].ValueString()]; ok {
+		if name == "has-env" {
+			return HasEnv(funcs, env, e[1:])
+		}
+		if name == "let" || name == "let*" {
+			return Let(funcs, env, e[1:], name == "let*")
+		}
+		if name == "lambda" {
+			return MakeLambda(funcs, env, e[1:])
+		}
+		if name == "defun" {
+			return NewErrorStatement(fmt.Errorf("function `defun' is allowed only at top level, see RegisterFunctions"))
+		}
+		if name == "quote" {
+			if len(e) != 2 {
+				return NewErrorStatement(fmt.Errorf("function `quote' required one param"))
+			}
+			return e[1]
+		}
+		if name == "quasiquote" {
+			return Quasiquote(funcs, env, e[1:])
+		}
+		if name == "unquote" || name == "unquote-splicing" {
+			return NewErrorStatement(fmt.Errorf("function `%s' is allowed only inside quasiquote", name))
+		}
+		if name == "defmacro" {
+			return NewErrorStatement(fmt.Errorf("function `defmacro' is allowed only at top level, see ExpandProgram"))
+		}
+		if fhandler, ok := (*funcs)[name]; ok {
 			return fhandler(funcs, env, e[1:])
 		}
-		return NewErrorStatement(fmt.Errorf("function %s not found", e[0].ValueString()))
+		if f, ok := envFunction(env, name); ok {
+			return f.Call(funcs, env, e[1:])
+		}
+		return NewErrorStatement(fmt.Errorf("function %s not found", name))
 	}
-	// `env` second form (`!`)
-	if expr.Type() == STString && expr.ValueString()[0] == '!' {
+	// `env` second form (`!`), `!key?' is optional
+	if expr.Type() == STString && !expr.Quoted() && strings.HasPrefix(expr.ValueString(), "!") {
+		if key, ok := strings.CutSuffix(expr.ValueString()[1:], "?"); ok && key != "" {
+			return getOptionalFromEnv(env, key)
+		}
 		key := NewStringStatement(expr.ValueString()[1:])
 		return GetFromEnv(funcs, env, []Statement{key})
 	}
 	return *expr
 }
+
+// Evaluate forms in order, returns value of the last one
+// evaluation stops at the first error
+func EvalProgram(funcs *FunctionMap, env *Environment, program []Statement) Statement {
+	if len(program) == 0 {
+		return NewErrorStatement(fmt.Errorf("empty program"))
+	}
+	var res Statement
+	for i := range program {
+		res = Eval(funcs, env, &program[i])
+		if res.Type() == STError {
+			return res
+		}
+	}
+	return res
+}
+
+// Evaluate all forms in order, returns value of every form
+func EvalProgramAll(funcs *FunctionMap, env *Environment, program []Statement) []Statement {
+	res := make([]Statement, len(program))
+	for i := range program {
+		res[i] = Eval(funcs, env, &program[i])
+	}
+	return res
+}
@@ -0,0 +1,308 @@
+package microlisp
+
+import (
+	"fmt"
+	"math"
+)
+
+// Arithmetic functions with DefaultDecimalContext
+var ArithmeticFunctions = NewArithmeticFunctions(DefaultDecimalContext)
+
+// Arithmetic functions
+// all params are evaluated, promotion rules:
+//   - int with int gives int (`/' gives float64 always), overflow is an error
+//   - int with float gives float, float64 if any param is float64
+//   - decimal with int or decimal gives decimal, decimal with float is an error,
+//     `/' gives ctx.Scale digits after point
+//   - float array with number or float array applies operation element-wise
+func NewArithmeticFunctions(ctx DecimalContext) FunctionMap {
+	return FunctionMap{
+		"+": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			return arithmeticFold("+", funcs, env, expr, nil, numberOps{
+				addInt,
+				func(a, b float64) (float64, error) { return a + b, nil },
+				func(a, b Decimal) (Decimal, error) { return a.Add(b), nil },
+			})
+		},
+		"-": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			return arithmeticFold("-", funcs, env, expr, &zero, numberOps{
+				subInt,
+				func(a, b float64) (float64, error) { return a - b, nil },
+				func(a, b Decimal) (Decimal, error) { return a.Sub(b), nil },
+			})
+		},
+		"*": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			return arithmeticFold("*", funcs, env, expr, nil, numberOps{
+				mulInt,
+				func(a, b float64) (float64, error) { return a * b, nil },
+				func(a, b Decimal) (Decimal, error) { return a.Mul(b), nil },
+			})
+		},
+		"/": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			return arithmeticFold("/", funcs, env, expr, &one, numberOps{
+				nil,
+				func(a, b float64) (float64, error) {
+					if b == 0 {
+						return 0, errDivisionByZero
+					}
+					return a / b, nil
+				},
+				func(a, b Decimal) (Decimal, error) { return a.Quo(b, ctx.Scale, ctx.Mode) },
+			})
+		},
+		"mod": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			if len(expr) != 2 {
+				return NewErrorStatement(fmt.Errorf("function `mod' required 2 param"))
+			}
+			return arithmeticFold("mod", funcs, env, expr, nil, numberOps{
+				func(a, b int64) (int64, error) {
+					if b == 0 {
+						return 0, errDivisionByZero
+					}
+					if b == -1 { // MinInt64 % -1 panics
+						return 0, nil
+					}
+					m := a % b
+					if m != 0 && (m < 0) != (b < 0) { // sign of divisor
+						m += b
+					}
+					return m, nil
+				},
+				func(a, b float64) (float64, error) {
+					if b == 0 {
+						return 0, errDivisionByZero
+					}
+					m := math.Mod(a, b)
+					if m != 0 && (m < 0) != (b < 0) {
+						m += b
+					}
+					return m, nil
+				},
+				Decimal.Mod,
+			})
+		},
+		"min": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			return arithmeticFold("min", funcs, env, expr, nil, numberOps{
+				func(a, b int64) (int64, error) { return min(a, b), nil },
+				func(a, b float64) (float64, error) { return min(a, b), nil },
+				func(a, b Decimal) (Decimal, error) {
+					if b.Cmp(a) < 0 {
+						return b, nil
+					}
+					return a, nil
+				},
+			})
+		},
+		"max": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			return arithmeticFold("max", funcs, env, expr, nil, numberOps{
+				func(a, b int64) (int64, error) { return max(a, b), nil },
+				func(a, b float64) (float64, error) { return max(a, b), nil },
+				func(a, b Decimal) (Decimal, error) {
+					if b.Cmp(a) > 0 {
+						return b, nil
+					}
+					return a, nil
+				},
+			})
+		},
+		"abs": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			if len(expr) != 1 {
+				return NewErrorStatement(fmt.Errorf("function `abs' required one param"))
+			}
+			return arithmeticFold("abs", funcs, env, []Statement{NewIntStatement(0), expr[0]}, nil, numberOps{
+				func(_, b int64) (int64, error) {
+					if b == math.MinInt64 {
+						return 0, errIntegerOverflow
+					}
+					return max(b, -b), nil
+				},
+				func(_, b float64) (float64, error) { return math.Abs(b), nil },
+				func(_, b Decimal) (Decimal, error) { return b.Abs(), nil },
+			})
+		},
+		// (round x) gives int for float, (round x digits) gives x rounded to decimal digits,
+		// decimals are rounded with ctx.Mode or with mode given by name: (round x digits half-up),
+		// floats and ints always round half away from zero like math.Round, so with half-even ctx.Mode
+		// (round 2.5) is 3 but (round 2.5d) is 2d: float halves are rarely exact, decimal ones are
+		"round": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			if len(expr) < 1 || len(expr) > 3 {
+				return NewErrorStatement(fmt.Errorf("function `round' required 1 to 3 param"))
+			}
+			digits, mode := int64(0), ctx.Mode
+			if len(expr) >= 2 {
+				d := Eval(funcs, env, &expr[1])
+				if d.Type() == STError {
+					return d
+				}
+				if d.Type() != STInt {
+					return NewErrorStatement(fmt.Errorf("function `round' expect int digits"))
+				}
+				digits = d.ValueInt()
+				if digits > MaxDecimalScale || digits < -MaxDecimalScale {
+					return NewErrorStatement(fmt.Errorf("function `round' digits out of range"))
+				}
+			}
+			args, errStm := evalNumbers("round", funcs, env, expr[:1])
+			if errStm != nil {
+				return *errStm
+			}
+			if len(expr) == 3 {
+				m := Eval(funcs, env, &expr[2])
+				if m.Type() == STError {
+					return m
+				}
+				if args[0].Type() != STDecimal || m.Type() != STString {
+					return NewErrorStatement(fmt.Errorf("function `round' expect decimal param and mode name"))
+				}
+				var err error
+				if mode, err = ParseRoundingMode(m.ValueString()); err != nil {
+					return NewErrorStatement(fmt.Errorf("function `round' %w", err))
+				}
+			}
+			scale := math.Pow(10, float64(digits))
+			if x := args[0]; x.Type() == STFloat && len(expr) == 1 {
+				f := math.Round(x.ValueFloat())
+				if !(f >= math.MinInt64 && f < math.MaxInt64) {
+					return NewErrorStatement(fmt.Errorf("function `round' %w", errIntegerOverflow))
+				}
+				return NewIntStatement(int64(f))
+			}
+			return foldNumbers("round", []Statement{zero, args[0]}, numberOps{
+				func(_, b int64) (int64, error) {
+					if digits >= 0 {
+						return b, nil
+					}
+					return int64(math.Round(float64(b)*scale) / scale), nil
+				},
+				func(_, b float64) (float64, error) { return math.Round(b*scale) / scale, nil },
+				func(_, b Decimal) (Decimal, error) { return b.Round(int32(digits), mode), nil },
+			})
+		},
+	}
+}
+
+// Operations on pairs of numbers
+type numberOps struct {
+	intOp   func(a, b int64) (int64, error) // nil if int params give float64
+	floatOp func(a, b float64) (float64, error)
+	decOp   func(a, b Decimal) (Decimal, error)
+}
+
+var zero, one = NewIntStatement(0), NewIntStatement(1)
+
+var errDivisionByZero = fmt.Errorf("division by zero")
+var errIntegerOverflow = fmt.Errorf("integer overflow")
+var errDecimalFloat = fmt.Errorf("can not mix decimal and float params")
+
+func addInt(a, b int64) (int64, error) {
+	r := a + b
+	if (a > 0 && b > 0 && r < 0) || (a < 0 && b < 0 && r >= 0) {
+		return 0, errIntegerOverflow
+	}
+	return r, nil
+}
+
+func subInt(a, b int64) (int64, error) {
+	if b == math.MinInt64 {
+		if a >= 0 {
+			return 0, errIntegerOverflow
+		}
+		return a - b, nil
+	}
+	return addInt(a, -b)
+}
+
+func mulInt(a, b int64) (int64, error) {
+	if a == 0 || b == 0 {
+		return 0, nil
+	}
+	r := a * b
+	if r/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, errIntegerOverflow
+	}
+	return r, nil
+}
+
+// Evaluate params and fold them left with operation
+// unary is the left operand when there is only one param: (- x) is (- 0 x)
+func arithmeticFold(name string, funcs *FunctionMap, env *Environment, expr []Statement, unary *Statement,
+	ops numberOps) Statement {
+	if len(expr) == 0 {
+		return NewErrorStatement(fmt.Errorf("function `%s' required at least one param", name))
+	}
+	args, errStm := evalNumbers(name, funcs, env, expr)
+	if errStm != nil {
+		return *errStm
+	}
+	if len(args) == 1 && unary != nil {
+		args = append([]Statement{*unary}, args...)
+	}
+	return foldNumbers(name, args, ops)
+}
+
+// Evaluate params expecting numbers or float arrays, returns error statement on failure
+func evalNumbers(name string, funcs *FunctionMap, env *Environment, expr []Statement) ([]Statement, *Statement) {
+	args := make([]Statement, 0, len(expr))
+	for i := range expr {
+		v := Eval(funcs, env, &expr[i])
+		if v.Type() == STError {
+			return nil, &v
+		}
+		switch v.Type() {
+		case STInt, STFloat, STDecimal, STFloatArray:
+		default:
+			err := NewErrorStatement(fmt.Errorf("function `%s' expect number param", name))
+			return nil, &err
+		}
+		args = append(args, v)
+	}
+	return args, nil
+}
+
+func foldNumbers(name string, args []Statement, ops numberOps) Statement {
+	res := args[0]
+	for _, v := range args[1:] {
+		var err error
+		if res, err = arithmeticApply(res, v, ops); err != nil {
+			return NewErrorStatement(fmt.Errorf("function `%s' %w", name, err))
+		}
+	}
+	return res
+}
+
+func arithmeticApply(a, b Statement, ops numberOps) (Statement, error) {
+	if a.Type() == STDecimal || b.Type() == STDecimal {
+		if a.Type() != STInt && a.Type() != STDecimal || b.Type() != STInt && b.Type() != STDecimal {
+			return Statement{}, errDecimalFloat
+		}
+		d, err := ops.decOp(a.ValueDecimal(), b.ValueDecimal())
+		return NewDecimalStatement(d), err
+	}
+	if a.Type() == STFloatArray || b.Type() == STFloatArray {
+		x, y := a.ValueFloatArray(), b.ValueFloatArray()
+		n := len(x) // scalar operand is broadcast
+		if b.Type() == STFloatArray {
+			n = len(y)
+		}
+		if a.Type() == STFloatArray && b.Type() == STFloatArray && len(x) != len(y) {
+			return Statement{}, fmt.Errorf("float arrays of different length %d and %d", len(x), len(y))
+		}
+		res := make([]float32, n)
+		for i := range res {
+			f, err := ops.floatOp(float64(x[min(i, len(x)-1)]), float64(y[min(i, len(y)-1)]))
+			if err != nil {
+				return Statement{}, err
+			}
+			res[i] = float32(f)
+		}
+		return NewFloatArrayStatement(res), nil
+	}
+	if a.Type() == STInt && b.Type() == STInt && ops.intOp != nil {
+		i, err := ops.intOp(a.ValueInt(), b.ValueInt())
+		return NewIntStatement(i), err
+	}
+	f, err := ops.floatOp(a.ValueFloat(), b.ValueFloat())
+	// int params give float64, float32 is not precise enough for int64
+	wide := a.IsFloat64() || b.IsFloat64() || a.Type() == STInt && b.Type() == STInt
+	return newFloatResult(f, wide), err
+}
@@ -0,0 +1,211 @@
+package microlisp
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Comparison functions, chained over all params: (< 1 x 10) is 1 < x and x < 10,
+// (!= a b c) is (not (= a b c)).
+// params are evaluated from left to right until the result is known,
+// values are compared with CompareStatements, so (= 3 3.0) is true,
+// <, <=, > and >= give error for nil param, (= x nil) tests for nil
+var ComparisonFunctions = FunctionMap{
+	"=": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		return compareChain("=", funcs, env, expr, func(c int) bool { return c == 0 })
+	},
+	"!=": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		res := compareChain("!=", funcs, env, expr, func(c int) bool { return c == 0 })
+		if res.Type() == STBool {
+			return NewBoolStatement(!res.ValueBool())
+		}
+		return res
+	},
+	"<": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		return compareChain("<", funcs, env, expr, func(c int) bool { return c < 0 })
+	},
+	"<=": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		return compareChain("<=", funcs, env, expr, func(c int) bool { return c <= 0 })
+	},
+	">": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		return compareChain(">", funcs, env, expr, func(c int) bool { return c > 0 })
+	},
+	">=": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		return compareChain(">=", funcs, env, expr, func(c int) bool { return c >= 0 })
+	},
+}
+
+func compareChain(name string, funcs *FunctionMap, env *Environment, expr []Statement, ok func(c int) bool) Statement {
+	if len(expr) < 2 {
+		return NewErrorStatement(fmt.Errorf("function `%s' required at least 2 param", name))
+	}
+	ordering := name != "=" && name != "!="
+	prev := Eval(funcs, env, &expr[0])
+	if prev.Type() == STError {
+		return prev
+	}
+	if ordering && prev.Type() == STNil {
+		return NewErrorStatement(fmt.Errorf("function `%s' can not order nil", name))
+	}
+	for i := 1; i < len(expr); i++ {
+		v := Eval(funcs, env, &expr[i])
+		if v.Type() == STError {
+			return v
+		}
+		if ordering && v.Type() == STNil {
+			return NewErrorStatement(fmt.Errorf("function `%s' can not order nil", name))
+		}
+		if !ok(CompareStatements(prev, v)) {
+			return NewBoolStatement(false)
+		}
+		prev = v
+	}
+	return NewBoolStatement(true)
+}
+
+// Compare statements, returns -1, 0 or +1.
+// Values of different types are ordered by kind:
+//
+//	nil < bool < number < string < time < duration < float array < fuzzy set < list < map < function < expression < error < unknown
+//
+// ints, floats and decimals are numbers and are compared by value (NaN is less than any other number),
+// float32 with float64 in float32 precision,
+// false < true, strings are compared lexically by bytes, times as instants, errors by message,
+// float arrays, fuzzy sets, lists and expressions element by element, a prefix is less,
+// maps as lists of key and value pairs sorted by key, functions by their source form.
+// source comments, positions and quoting are ignored
+func CompareStatements(s1 Statement, s2 Statement) int {
+	if r1, r2 := compareRank(s1), compareRank(s2); r1 != r2 {
+		return cmp.Compare(r1, r2)
+	}
+	switch s1.Type() {
+	case STNil:
+		return 0
+	case STBool:
+		return cmp.Compare(boolInt(s1.ValueBool()), boolInt(s2.ValueBool()))
+	case STInt, STFloat, STDecimal:
+		return compareNumbers(s1, s2)
+	case STString:
+		return strings.Compare(s1.ValueString(), s2.ValueString())
+	case STTime:
+		return s1.ValueTime().Compare(s2.ValueTime())
+	case STDuration:
+		return cmp.Compare(s1.ValueDuration(), s2.ValueDuration())
+	case STFloatArray:
+		a1, a2 := s1.ValueFloatArray(), s2.ValueFloatArray()
+		for i := 0; i < len(a1) && i < len(a2); i++ {
+			if c := cmp.Compare(float64(a1[i]), float64(a2[i])); c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(len(a1), len(a2))
+	case STFuzzy:
+		f1, f2 := s1.Value.(FuzzySetType), s2.Value.(FuzzySetType)
+		for i := 0; i < len(f1) && i < len(f2); i++ {
+			if c := CompareStatements(f1[i].Value, f2[i].Value); c != 0 {
+				return c
+			}
+			if c := cmp.Compare(float64(f1[i].Percent), float64(f2[i].Percent)); c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(len(f1), len(f2))
+	case STList, STMap, STExpression:
+		e1, e2 := s1.ValueList(), s2.ValueList()
+		if s1.Type() == STMap {
+			e1, e2 = mapPairs(s1.ValueMap()), mapPairs(s2.ValueMap())
+		} else if s1.Type() == STExpression {
+			e1, e2 = s1.ValueExpression(), s2.ValueExpression()
+		}
+		for i := 0; i < len(e1) && i < len(e2); i++ {
+			if c := CompareStatements(e1[i], e2[i]); c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(len(e1), len(e2))
+	case STFunction:
+		return strings.Compare(Format(s1), Format(s2))
+	case STError:
+		return strings.Compare(s1.ValueError().Error(), s2.ValueError().Error())
+	default:
+		return strings.Compare(fmt.Sprint(s1.Value), fmt.Sprint(s2.Value))
+	}
+}
+
+// Position of statement kind in the ordering across types
+func compareRank(s Statement) int {
+	switch s.Type() {
+	case STNil:
+		return 0
+	case STBool:
+		return 1
+	case STInt, STFloat, STDecimal:
+		return 2
+	case STString:
+		return 3
+	case STTime:
+		return 4
+	case STDuration:
+		return 5
+	case STFloatArray:
+		return 6
+	case STFuzzy:
+		return 7
+	case STList:
+		return 8
+	case STMap:
+		return 9
+	case STFunction:
+		return 10
+	case STExpression:
+		return 11
+	case STError:
+		return 12
+	default:
+		return 13
+	}
+}
+
+// Ints, floats and decimals by value, exactly unless NaN or infinity is compared
+func compareNumbers(s1, s2 Statement) int {
+	if s1.Type() == STInt && s2.Type() == STInt {
+		return cmp.Compare(s1.ValueInt(), s2.ValueInt())
+	}
+	if s1.Type() == STFloat && s2.Type() == STFloat && (!s1.IsFloat64() || !s2.IsFloat64()) {
+		// compare in the lower precision like IsEqualStatements, float32 0.1 is float64 0.1
+		return cmp.Compare(float32(s1.ValueFloat()), float32(s2.ValueFloat()))
+	}
+	f1, f2 := s1.ValueFloat(), s2.ValueFloat()
+	if s1.Type() != STDecimal && s2.Type() != STDecimal && isExactFloat(s1) && isExactFloat(s2) ||
+		math.IsNaN(f1) || math.IsNaN(f2) || math.IsInf(f1, 0) || math.IsInf(f2, 0) {
+		return cmp.Compare(f1, f2)
+	}
+	return numberRat(s1).Cmp(numberRat(s2))
+}
+
+// Is number exactly represented by ValueFloat
+func isExactFloat(s Statement) bool {
+	const maxExactInt = 1 << 53
+	return s.Type() == STFloat || s.ValueInt() >= -maxExactInt && s.ValueInt() <= maxExactInt
+}
+
+// Exact value of finite number
+func numberRat(s Statement) *big.Rat {
+	switch s.Type() {
+	case STInt:
+		return new(big.Rat).SetInt64(s.ValueInt())
+	case STDecimal:
+		return s.ValueDecimal().Rat()
+	}
+	return new(big.Rat).SetFloat64(s.ValueFloat())
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
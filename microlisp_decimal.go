@@ -0,0 +1,259 @@
+package microlisp
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Arbitrary-precision decimal number: coef * 10^-scale, written as 12.50d in source.
+// values are immutable, scale is kept: 12.50d has scale 2
+type Decimal struct {
+	coef  *big.Int
+	scale int32
+}
+
+type RoundingMode uint8
+
+const (
+	RoundHalfEven RoundingMode = iota // to nearest, ties to even digit
+	RoundHalfUp                       // to nearest, ties away from zero
+	RoundHalfDown                     // to nearest, ties toward zero
+	RoundDown                         // toward zero
+	RoundUp                           // away from zero
+	RoundFloor                        // toward negative infinity
+	RoundCeiling                      // toward positive infinity
+)
+
+var roundingModeNames = []string{"half-even", "half-up", "half-down", "down", "up", "floor", "ceiling"}
+
+func (m RoundingMode) String() string {
+	if int(m) < len(roundingModeNames) {
+		return roundingModeNames[m]
+	}
+	return fmt.Sprintf("RoundingMode(%d)", m)
+}
+
+// Rounding mode by name: half-even, half-up, half-down, down, up, floor, ceiling
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	for i, name := range roundingModeNames {
+		if s == name {
+			return RoundingMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rounding mode `%s'", s)
+}
+
+// Settings of decimal division
+type DecimalContext struct {
+	Scale int32        // digits after point in quotient
+	Mode  RoundingMode // rounding of quotient and of round function
+}
+
+var DefaultDecimalContext = DecimalContext{Scale: 16, Mode: RoundHalfEven}
+
+// Limit of scale and exponent in parsed decimals
+const MaxDecimalScale = 1000
+
+var ErrorInvalidDecimal = fmt.Errorf("invalid decimal")
+
+func NewDecimal(coef int64, scale int32) Decimal {
+	return Decimal{big.NewInt(coef), scale}
+}
+
+// Decimal from text like -12.50 or 1.5e-3
+func ParseDecimal(s string) (Decimal, error) {
+	mant, exp := s, int64(0)
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		var err error
+		if exp, err = strconv.ParseInt(s[i+1:], 10, 32); err != nil {
+			return Decimal{}, ErrorInvalidDecimal
+		}
+		mant = s[:i]
+	}
+	digits := strings.TrimLeft(mant, "+-")
+	if len(mant)-len(digits) > 1 {
+		return Decimal{}, ErrorInvalidDecimal
+	}
+	intPart, frac, _ := strings.Cut(digits, ".")
+	if intPart == "" && frac == "" || strings.Trim(intPart+frac, "0123456789") != "" {
+		return Decimal{}, ErrorInvalidDecimal
+	}
+	scale := int64(len(frac)) - exp
+	if scale > MaxDecimalScale || scale < -MaxDecimalScale {
+		return Decimal{}, ErrorInvalidDecimal
+	}
+	coef, _ := new(big.Int).SetString(intPart+frac, 10)
+	if strings.HasPrefix(mant, "-") {
+		coef.Neg(coef)
+	}
+	if scale < 0 {
+		return Decimal{coef.Mul(coef, pow10(int32(-scale))), 0}, nil
+	}
+	return Decimal{coef, int32(scale)}, nil
+}
+
+func pow10(n int32) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func (d Decimal) bigCoef() *big.Int {
+	if d.coef == nil {
+		return new(big.Int)
+	}
+	return d.coef
+}
+
+func (d Decimal) Scale() int32 {
+	return d.scale
+}
+
+// Text like -12.50, without suffix
+func (d Decimal) String() string {
+	s := new(big.Int).Abs(d.bigCoef()).String()
+	if d.scale > 0 {
+		if len(s) <= int(d.scale) {
+			s = strings.Repeat("0", int(d.scale)-len(s)+1) + s
+		}
+		s = s[:len(s)-int(d.scale)] + "." + s[len(s)-int(d.scale):]
+	}
+	if d.Sign() < 0 {
+		return "-" + s
+	}
+	return s
+}
+
+func (d Decimal) Sign() int {
+	return d.bigCoef().Sign()
+}
+
+// Coefficients of d and e with the same scale
+func (d Decimal) align(e Decimal) (*big.Int, *big.Int, int32) {
+	a, b := d.bigCoef(), e.bigCoef()
+	switch {
+	case d.scale < e.scale:
+		a = new(big.Int).Mul(a, pow10(e.scale-d.scale))
+	case d.scale > e.scale:
+		b = new(big.Int).Mul(b, pow10(d.scale-e.scale))
+	}
+	return a, b, max(d.scale, e.scale)
+}
+
+func (d Decimal) Add(e Decimal) Decimal {
+	a, b, scale := d.align(e)
+	return Decimal{new(big.Int).Add(a, b), scale}
+}
+
+func (d Decimal) Sub(e Decimal) Decimal {
+	a, b, scale := d.align(e)
+	return Decimal{new(big.Int).Sub(a, b), scale}
+}
+
+func (d Decimal) Mul(e Decimal) Decimal {
+	return Decimal{new(big.Int).Mul(d.bigCoef(), e.bigCoef()), d.scale + e.scale}
+}
+
+// Quotient d/e rounded to scale digits after point
+func (d Decimal) Quo(e Decimal, scale int32, mode RoundingMode) (Decimal, error) {
+	if e.Sign() == 0 {
+		return Decimal{}, errDivisionByZero
+	}
+	num, den := new(big.Int).Set(d.bigCoef()), new(big.Int).Set(e.bigCoef())
+	// d/e = num/den * 10^(e.scale-d.scale), result coef is d/e * 10^scale
+	if shift := scale + e.scale - d.scale; shift >= 0 {
+		num.Mul(num, pow10(shift))
+	} else {
+		den.Mul(den, pow10(-shift))
+	}
+	return Decimal{roundQuo(num, den, mode), scale}, nil
+}
+
+// Floored remainder of d/e, it has sign of e
+func (d Decimal) Mod(e Decimal) (Decimal, error) {
+	if e.Sign() == 0 {
+		return Decimal{}, errDivisionByZero
+	}
+	a, b, scale := d.align(e)
+	m := new(big.Int).Rem(a, b)
+	if m.Sign() != 0 && m.Sign() != b.Sign() {
+		m.Add(m, b)
+	}
+	return Decimal{m, scale}, nil
+}
+
+// Rounded to scale digits after point, negative scale rounds to tens, hundreds...
+func (d Decimal) Round(scale int32, mode RoundingMode) Decimal {
+	if scale >= d.scale {
+		return d
+	}
+	q := roundQuo(new(big.Int).Set(d.bigCoef()), pow10(d.scale-scale), mode)
+	if scale < 0 {
+		return Decimal{q.Mul(q, pow10(-scale)), 0}
+	}
+	return Decimal{q, scale}
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{new(big.Int).Neg(d.bigCoef()), d.scale}
+}
+
+func (d Decimal) Abs() Decimal {
+	return Decimal{new(big.Int).Abs(d.bigCoef()), d.scale}
+}
+
+// Compare by value, returns -1, 0 or +1: 1.50d and 1.5d are equal
+func (d Decimal) Cmp(e Decimal) int {
+	a, b, _ := d.align(e)
+	return a.Cmp(b)
+}
+
+func (d Decimal) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(d.bigCoef(), pow10(d.scale))
+}
+
+func (d Decimal) Float64() float64 {
+	f, _ := d.Rat().Float64()
+	return f
+}
+
+// num/den rounded to integer, num is reused
+func roundQuo(num, den *big.Int, mode RoundingMode) *big.Int {
+	q, r := num.QuoRem(num, den, new(big.Int))
+	if r.Sign() == 0 {
+		return q
+	}
+	// sign of exact quotient, q is truncated toward zero
+	sign := r.Sign() * den.Sign()
+	half := new(big.Int).Abs(r)
+	half.Lsh(half, 1)
+	tie := half.CmpAbs(den) // compare 2|r| with |den|
+	away := false
+	switch mode {
+	case RoundHalfEven:
+		away = tie > 0 || tie == 0 && q.Bit(0) == 1
+	case RoundHalfUp:
+		away = tie >= 0
+	case RoundHalfDown:
+		away = tie > 0
+	case RoundUp:
+		away = true
+	case RoundFloor:
+		away = sign < 0
+	case RoundCeiling:
+		away = sign > 0
+	}
+	if away {
+		q.Add(q, big.NewInt(int64(sign)))
+	}
+	return q
+}
+
+// Decimal literal: digits with optional point and exponent followed by d, like 12.50d
+func parseDecimalLiteral(s string) (Decimal, bool) {
+	if len(s) < 2 || s[len(s)-1] != 'd' {
+		return Decimal{}, false
+	}
+	d, err := ParseDecimal(s[:len(s)-1])
+	return d, err == nil
+}
@@ -1,5 +1,15 @@
 package microlisp
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 //
 
 func NewEnvironment() Environment {
@@ -10,37 +20,282 @@ func (env Environment) Add(key string, val Statement) {
 	env[key] = val
 }
 
+// Value of key in env or in its parent scopes
 func (env Environment) Get(key string) (Statement, bool) {
-	v, ok := env[key]
-	return v, ok
+	for {
+		if v, ok := env[key]; ok {
+			return v, true
+		}
+		parent, ok := env[parentKey].Value.(Environment)
+		if !ok {
+			return Statement{}, false
+		}
+		env = parent
+	}
+}
+
+// Child scope of env: keys of env are visible through Get,
+// bindings added to it are not visible in env, env is not copied.
+// child holds env under a reserved key, so len and range over it do not give bindings only
+func (env Environment) Child() Environment {
+	if env == nil {
+		return NewEnvironment()
+	}
+	return Environment{parentKey: Statement{Value: env}}
+}
+
+// Top-level scope of env, the one without parent
+func (env Environment) root() Environment {
+	for {
+		parent, ok := env[parentKey].Value.(Environment)
+		if !ok {
+			return env
+		}
+		env = parent
+	}
+}
+
+// Key of parent scope in child one
+const parentKey = "\x00parent"
+
+// Keys starting with NUL hold scope details (parent scope, call depth),
+// they are not visible through GetPath and can not be bound by `let' or params
+func isReservedKey(key string) bool {
+	return strings.HasPrefix(key, "\x00")
+}
+
+// Value by path of keys: customer.tier, orders[0].total, data["a.b"][1],
+// brackets hold list index or quoted map key, key as a whole is tried first.
+// path through nil or value which is not map or list gives ErrorKeyNotFound
+func (env Environment) GetPath(path string) (Statement, error) {
+	if isReservedKey(path) {
+		return Statement{}, fmt.Errorf("environment key `%s' %w", path, ErrorKeyNotFound)
+	}
+	if v, ok := env.Get(path); ok {
+		return v, nil
+	}
+	keys, err := parseEnvPath(path)
+	if err != nil {
+		return Statement{}, fmt.Errorf("environment path `%s' %w", path, err)
+	}
+	v, ok := env.Get(keys[0].ValueString())
+	if !ok || len(keys) == 1 {
+		if !ok {
+			return Statement{}, fmt.Errorf("environment key `%s' %w", path, ErrorKeyNotFound)
+		}
+		return v, nil
+	}
+	for _, k := range keys[1:] {
+		if v, err = getChild(v, k); err != nil {
+			// sparse input: path through nil or scalar value is not found
+			if errors.Is(err, errMissingKey) || !errors.Is(err, errWrongKey) {
+				return Statement{}, fmt.Errorf("environment key `%s' %w", path, ErrorKeyNotFound)
+			}
+			return Statement{}, fmt.Errorf("environment path `%s' %w", path, err)
+		}
+	}
+	return v, nil
+}
+
+var ErrorKeyNotFound = fmt.Errorf("not found")
+var ErrorInvalidPath = fmt.Errorf("is invalid")
+
+// Split path to string keys and int indexes
+func parseEnvPath(path string) ([]Statement, error) {
+	var keys []Statement
+	for i := 0; i < len(path); {
+		switch {
+		case path[i] == '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, ErrorInvalidPath
+			}
+			inner := path[i+1 : i+end]
+			if strings.HasPrefix(inner, `"`) {
+				end = i + 1 + closingQuote(path[i+1:])
+				if end <= i+1 || end+1 >= len(path) || path[end+1] != ']' {
+					return nil, ErrorInvalidPath
+				}
+				k, err := unescapeString(path[i+2 : end])
+				if err != nil {
+					return nil, ErrorInvalidPath
+				}
+				keys = append(keys, NewStringStatement(k))
+				i = end + 2
+			} else if n, err := strconv.ParseInt(inner, 10, 64); err == nil {
+				keys = append(keys, NewIntStatement(n))
+				i += end + 1
+			} else {
+				return nil, ErrorInvalidPath
+			}
+			if i < len(path) && path[i] != '.' && path[i] != '[' {
+				return nil, ErrorInvalidPath
+			}
+		case path[i] == '.' && i > 0:
+			i++
+			fallthrough
+		default:
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			if end == 0 {
+				return nil, ErrorInvalidPath
+			}
+			keys = append(keys, NewStringStatement(path[i:i+end]))
+			i += end
+		}
+	}
+	if len(keys) == 0 || keys[0].Type() != STString {
+		return nil, ErrorInvalidPath
+	}
+	return keys, nil
+}
+
+// Index of quote closing string literal which starts s, -1 if none
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
 }
 
+// Settings of JSON object conversion
+type JsonOptions struct {
+	Float64 bool // keep float numbers as float64 instead of float32
+	Decimal bool // convert float numbers to decimals, exactly from text for json.Number
+	// conversion of subobjects which paths are not in Schema
+	Objects JsonObjectKind
+	// conversion of subobjects and strings by path of keys from the top object joined with dots,
+	// like "customer" or "customer.address", elements of arrays have path of the array
+	Schema map[string]JsonObjectKind
+}
+
+type JsonObjectKind uint8
+
+const (
+	JsonFuzzy JsonObjectKind = iota // fuzzy set of number members, other members are dropped
+	JsonMap                         // map of all members
+	JsonAuto                        // fuzzy set if all members are numbers, map otherwise
+	JsonTime                        // string in RFC 3339 or date only format is time, for Schema only
+)
+
 // Convert JSON object to Environment
-// Subobjects interpret as FuzzySet
+// Subobjects interpret as FuzzySet, arrays as List
 func JsonMapToEnvironment(inp map[string]interface{}) Environment {
+	return JsonMapToEnvironmentWithOptions(inp, JsonOptions{})
+}
+
+// json.Number (see json.Decoder.UseNumber) is converted to int if it has no fraction or exponent
+// null values are nil
+func JsonMapToEnvironmentWithOptions(inp map[string]interface{}, opts JsonOptions) Environment {
 	var res = NewEnvironment()
 	for k, v := range inp {
-		switch vv := v.(type) {
-		case string:
-			res.Add(k, NewStringStatement(vv))
-		case int:
-			res.Add(k, NewIntStatement(vv))
-		case float64:
-			res.Add(k, NewFloatStatement(float32(vv)))
-		case bool:
-			res.Add(k, NewBoolStatement(vv))
-		case map[string]interface{}:
-			{ //fuzzy set, expect {"stringkey": float...}
-				fuz := make(FuzzySetType, 0)
-				for k1, v1 := range vv {
-					percent, ok := v1.(float64)
-					if ok {
-						fuz = append(fuz, FuzzyElement{NewStringStatement(k1), float32(percent)})
-					}
+		if stm, ok := jsonStatement(v, k, opts); ok {
+			res.Add(k, stm)
+		}
+	}
+	return res
+}
+
+func jsonStatement(v interface{}, path string, opts JsonOptions) (Statement, bool) {
+	switch vv := v.(type) {
+	case string:
+		if opts.Schema[path] == JsonTime {
+			if t, ok := parseTimeLiteral(vv); ok {
+				return NewTimeStatement(t), true
+			}
+			return NewErrorStatement(fmt.Errorf("environment key `%s' is not a time: %s", path, vv)), true
+		}
+		return NewStringStatement(vv), true
+	case int:
+		return NewIntStatement(int64(vv)), true
+	case int64:
+		return NewIntStatement(vv), true
+	case json.Number:
+		if i, err := vv.Int64(); err == nil {
+			return NewIntStatement(i), true
+		} else if d, err := ParseDecimal(vv.String()); err == nil && opts.Decimal {
+			return NewDecimalStatement(d), true
+		} else if f, err := vv.Float64(); err == nil {
+			return newFloatResult(f, opts.Float64), true
+		}
+	case float64:
+		// json.Unmarshal gives float64 for all numbers, whole ones below 2^53 are exact ints
+		if vv == math.Trunc(vv) && math.Abs(vv) < 1<<53 {
+			return NewIntStatement(int64(vv)), true
+		}
+		if opts.Decimal { // shortest text which is read back as the same float64
+			if d, err := ParseDecimal(strconv.FormatFloat(vv, 'g', -1, 64)); err == nil {
+				return NewDecimalStatement(d), true
+			}
+		}
+		return newFloatResult(vv, opts.Float64), true
+	case bool:
+		return NewBoolStatement(vv), true
+	case nil:
+		return NewNilStatement(), true
+	case []interface{}:
+		list := make([]Statement, 0, len(vv))
+		for _, v1 := range vv {
+			if stm, ok := jsonStatement(v1, path, opts); ok {
+				list = append(list, stm)
+			}
+		}
+		return NewListStatement(list), true
+	case map[string]interface{}:
+		kind, ok := opts.Schema[path]
+		if !ok {
+			kind = opts.Objects
+		}
+		if kind == JsonAuto {
+			kind = JsonFuzzy
+			for _, v1 := range vv {
+				if _, ok := jsonPercent(v1); !ok {
+					kind = JsonMap
+					break
+				}
+			}
+		}
+		if kind == JsonMap {
+			m := make(map[string]Statement, len(vv))
+			for k1, v1 := range vv {
+				if stm, ok := jsonStatement(v1, path+"."+k1, opts); ok {
+					m[k1] = stm
+				}
+			}
+			return NewMapStatement(m), true
+		}
+		{ //fuzzy set, expect {"stringkey": float...}, keys are sorted
+			keys := make([]string, 0, len(vv))
+			for k1 := range vv {
+				keys = append(keys, k1)
+			}
+			sort.Strings(keys)
+			fuz := make(FuzzySetType, 0)
+			for _, k1 := range keys {
+				if percent, ok := jsonPercent(vv[k1]); ok {
+					fuz = append(fuz, FuzzyElement{NewStringStatement(k1), percent})
 				}
-				res.Add(k, NewFuzzyStatement(fuz))
 			}
+			return NewFuzzyStatement(fuz), true
 		}
 	}
-	return res
+	return Statement{}, false
+}
+
+func jsonPercent(v interface{}) (float32, bool) {
+	switch vv := v.(type) {
+	case float64:
+		return float32(vv), true
+	case json.Number:
+		f, err := vv.Float64()
+		return float32(f), err == nil
+	}
+	return 0, false
 }
@@ -0,0 +1,199 @@
+package microlisp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Source text of statement in one line, Parse(Format(s)) gives an equal statement
+// lists and maps are printed as (list ...) and (hash-map ...) expressions, which evaluate to the same value,
+// functions as (lambda ...) expressions without their closure scope, quote forms as 'x `x ,x ,@x,
+// errors and unknown values are printed as block comments, source comments are not printed (see Pretty)
+func Format(s Statement) string {
+	var b strings.Builder
+	writeStatement(&b, s, false)
+	return b.String()
+}
+
+func (s Statement) String() string {
+	return Format(s)
+}
+
+// head is set for the first element of an expression (function name), it is never converted by parser
+func writeStatement(b *strings.Builder, s Statement, head bool) {
+	switch s.Type() {
+	case STExpression:
+		if prefix := quotePrefix(s.ValueExpression()); prefix != "" {
+			b.WriteString(prefix)
+			writeStatement(b, s.ValueExpression()[1], false)
+			break
+		}
+		b.WriteByte('(')
+		for i, e := range s.ValueExpression() {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			writeStatement(b, e, i == 0)
+		}
+		b.WriteByte(')')
+	case STString:
+		if !s.Quoted() && isBareAtom(s.ValueString(), head) {
+			b.WriteString(s.ValueString())
+		} else {
+			b.WriteString(QuoteString(s.ValueString()))
+		}
+	case STInt:
+		b.WriteString(strconv.FormatInt(s.ValueInt(), 10))
+	case STFloat:
+		if s.IsFloat64() {
+			b.WriteString(formatFloatBits(s.ValueFloat(), 64))
+		} else {
+			b.WriteString(formatFloat(float32(s.ValueFloat())))
+		}
+	case STFloatArray:
+		b.WriteByte('[')
+		for i, f := range s.ValueFloatArray() {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(formatFloat(f))
+		}
+		b.WriteByte(']')
+	case STList:
+		b.WriteString("(list")
+		for _, e := range s.ValueList() {
+			b.WriteByte(' ')
+			writeStatement(b, dataElement(e), false)
+		}
+		b.WriteByte(')')
+	case STMap:
+		b.WriteString("(hash-map")
+		for _, e := range mapPairs(s.ValueMap()) {
+			b.WriteByte(' ')
+			writeStatement(b, dataElement(e), false)
+		}
+		b.WriteByte(')')
+	case STBool:
+		b.WriteString(strconv.FormatBool(s.ValueBool()))
+	case STNil:
+		b.WriteString("nil")
+	case STTime:
+		b.WriteString(s.ValueTime().Format(time.RFC3339Nano))
+	case STDuration:
+		b.WriteString(s.ValueDuration().String())
+	case STDecimal:
+		b.WriteString(s.ValueDecimal().String())
+		b.WriteByte('d')
+	case STFunction:
+		writeStatement(b, NewExpressionStatement(s.ValueFunction().expression()), false)
+	case STFuzzy:
+		b.WriteByte('{')
+		for i, e := range s.Value.(FuzzySetType) {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			writeStatement(b, e.Value, false)
+			b.WriteByte(':')
+			b.WriteString(formatFloat(e.Percent))
+		}
+		b.WriteByte('}')
+	case STError:
+		writeBlockComment(b, "error: "+s.ValueError().Error())
+	default:
+		writeBlockComment(b, fmt.Sprintf("unknown: %v", s.Value))
+	}
+}
+
+func formatFloat(f float32) string {
+	return formatFloatBits(float64(f), 32)
+}
+
+// Float with a point or exponent, so it is not read back as int
+func formatFloatBits(f float64, bitSize int) string {
+	res := strconv.FormatFloat(f, 'g', -1, bitSize)
+	if !strings.ContainsAny(res, ".eIN") {
+		res += ".0"
+	}
+	return res
+}
+
+func writeBlockComment(b *strings.Builder, text string) {
+	text = strings.ReplaceAll(text, "|#", "| #")
+	text = strings.ReplaceAll(text, "#|", "# |")
+	b.WriteString("#| ")
+	b.WriteString(text)
+	b.WriteString(" |#")
+}
+
+// Can string be written without quotes and read back as the same string
+// Reader shorthand of (quote x), (quasiquote x), (unquote x) and (unquote-splicing x): 'x `x ,x ,@x,
+// empty if e is not such form
+func quotePrefix(e []Statement) string {
+	if len(e) != 2 || e[0].Type() != STString || e[0].Quoted() || len(e[0].Comments()) > 0 || len(e[0].Trailing()) > 0 {
+		return ""
+	}
+	switch e[0].ValueString() {
+	case "quote":
+		return "'"
+	case "quasiquote":
+		return "`"
+	case "unquote":
+		if e[1].Type() == STString && !e[1].Quoted() && strings.HasPrefix(e[1].ValueString(), "@") {
+			return "" // ,@x is unquote-splicing
+		}
+		return ","
+	case "unquote-splicing":
+		return ",@"
+	}
+	return ""
+}
+
+// Element of list or map printed as argument of (list ...) or (hash-map ...):
+// string which looks like `env' reference is quoted, so it is not evaluated
+func dataElement(s Statement) Statement {
+	if s.Type() == STString && !s.Quoted() && strings.HasPrefix(s.ValueString(), "!") {
+		return NewQuotedStringStatement(s.ValueString())
+	}
+	return s
+}
+
+func isBareAtom(s string, head bool) bool {
+	if s == "" || !isAtomRune(rune(s[0])) || strings.HasPrefix(s, "#|") {
+		return false
+	}
+	sc := newScanner(strings.NewReader(s))
+	if tok, err := sc.scan(); err != nil || tok.val != s {
+		return false
+	}
+	return head || NewStatement(s, true).Type() == STString
+}
+
+// String literal with escapes understood by the parser
+func QuoteString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default: // invalid bytes are kept as is
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -31,63 +31,69 @@ func FuzzyEq(set FuzzySetType, find Statement) Statement {
 func FuzzyEqSlice(set FuzzySetType, find []Statement) Statement {
 	var res float32
 	for _, f := range find {
-		res += FuzzyEq(set, f).ValueFloat()
+		res += float32(FuzzyEq(set, f).ValueFloat())
 	}
 	return NewFloatStatement(res)
 }
 
 // Fuzzy logic functions (first-order logic)
+// nil is 0.0
+// result is float64 if any param is float64
 var FuzzyLogicFunctions = FunctionMap{
 	"fnot": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
 		if len(expr) != 1 {
 			return NewErrorStatement(fmt.Errorf("Function `fnot' required one param"))
 		}
-		v := Eval(funcs, env, &expr[0])
+		v := nilAs(Eval(funcs, env, &expr[0]), NewFloatStatement(0))
 		if v.Type() == STError {
 			return v
 		}
 		if v.Type() != STFloat {
 			return NewErrorStatement(fmt.Errorf("Function `fnot' expect float param"))
 		}
-		return NewFloatStatement(1.0 - v.ValueFloat())
+		return newFloatResult(1.0-v.ValueFloat(), v.IsFloat64())
 	},
 	"fand": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
-		var res float32 = 1.0
+		var res float64 = 1.0
+		wide := false
 		if len(expr) == 0 {
 			return NewErrorStatement(fmt.Errorf("Function `fand' required at least one param"))
 		}
 		for _, e := range expr {
-			v := Eval(funcs, env, &e)
+			v := nilAs(Eval(funcs, env, &e), NewFloatStatement(0))
 			if v.Type() == STError {
 				return v
 			}
 			if v.Type() != STFloat {
 				return NewErrorStatement(fmt.Errorf("Function `fand' expect float param"))
 			}
+			wide = wide || v.IsFloat64()
 			if v.ValueFloat() < res {
 				res = v.ValueFloat()
 			}
 		}
-		return NewFloatStatement(res)
+		return newFloatResult(res, wide)
 	},
 	"for": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
-		var res float32 = 0.0
+		var res float64 = 0.0
+		wide := false
 		if len(expr) == 0 {
 			return NewErrorStatement(fmt.Errorf("Function `for' required at least one param"))
 		}
 		for _, e := range expr {
-			v := Eval(funcs, env, &e)
+			v := nilAs(Eval(funcs, env, &e), NewFloatStatement(0))
 			if v.Type() == STError {
 				return v
 			}
 			if v.Type() != STFloat {
 				return NewErrorStatement(fmt.Errorf("Function `for' expect float param"))
 			}
+			wide = wide || v.IsFloat64()
 			if v.ValueFloat() > res {
 				res = v.ValueFloat()
 			}
 		}
-		return NewFloatStatement(res)
+		return newFloatResult(res, wide)
 	},
 	/*
 		// TODO: make correct fuzzy ternary op
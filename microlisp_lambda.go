@@ -0,0 +1,178 @@
+package microlisp
+
+import (
+	"fmt"
+	"slices"
+)
+
+// User-defined function made by `lambda' or `defun'
+// params are bound in a child scope of Env where body is evaluated
+type Lambda struct {
+	Name   string // name given by `defun', empty for `lambda'
+	Params []string
+	Body   []Statement
+	// scope where `lambda' was made; for `defun' bindings of top-level `let' around it, nil if none,
+	// body of `defun' sees them and top-level environment of the caller, not bindings of the caller
+	Env Environment
+}
+
+// Limit of nested calls of user-defined functions
+const MaxCallDepth = 1000
+
+var ErrorCallDepth = fmt.Errorf("call depth limit exceeded")
+
+// Key of call depth in scope of function body, see isReservedKey
+const callDepthKey = "\x00depth"
+
+// Forms evaluated by Eval itself, they can not be redefined by `defun'
+var coreForms = map[string]bool{
+	"env": true, "has-env": true, "let": true, "let*": true, "lambda": true, "defun": true,
+	"quote": true, "quasiquote": true, "unquote": true, "unquote-splicing": true, "defmacro": true,
+}
+
+// `lambda' form: (lambda (params...) body...), closure over bindings of current scope
+func MakeLambda(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+	f, err := newLambda("lambda", expr)
+	if err != nil {
+		return NewErrorStatement(err)
+	}
+	f.Env = *env
+	if f.Env == nil {
+		f.Env = NewEnvironment()
+	}
+	return NewFunctionStatement(f)
+}
+
+func newLambda(form string, expr []Statement) (*Lambda, error) {
+	if len(expr) < 2 {
+		return nil, fmt.Errorf("function `%s' required params and body", form)
+	}
+	if expr[0].Type() != STExpression {
+		return nil, fmt.Errorf("function `%s' expect list of params", form)
+	}
+	f := &Lambda{Body: expr[1:]}
+	for _, p := range expr[0].ValueExpression() {
+		if !isBindingName(p) {
+			return nil, fmt.Errorf("function `%s' expect param name", form)
+		}
+		f.Params = append(f.Params, p.ValueString())
+	}
+	return f, nil
+}
+
+// Call function: params are evaluated in env, body in the function scope
+func (f *Lambda) Call(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+	name := f.Name
+	if name == "" {
+		name = "lambda"
+	}
+	if len(expr) != len(f.Params) {
+		return NewErrorStatement(fmt.Errorf("function `%s' required %d param", name, len(f.Params)))
+	}
+	d, _ := (*env).Get(callDepthKey)
+	depth := d.ValueInt() + 1
+	if depth > MaxCallDepth {
+		return NewErrorStatement(fmt.Errorf("function `%s' %w", name, ErrorCallDepth))
+	}
+	var scope Environment
+	if f.Name == "" {
+		scope = f.Env.Child()
+	} else {
+		scope = (*env).root().Child()
+		for k, v := range f.Env { // bindings of `let' around `defun', they are few
+			scope[k] = v
+		}
+	}
+	for i, p := range f.Params {
+		v := Eval(funcs, env, &expr[i])
+		if v.Type() == STError {
+			return v
+		}
+		scope[p] = v
+	}
+	scope[callDepthKey] = NewIntStatement(depth)
+	return EvalProgram(funcs, &scope, f.Body)
+}
+
+// Source form of function: (lambda (params...) body...)
+func (f *Lambda) expression() []Statement {
+	params := make([]Statement, len(f.Params))
+	for i, p := range f.Params {
+		params[i] = NewStringStatement(p)
+	}
+	return append([]Statement{NewStringStatement("lambda"), NewExpressionStatement(params)}, f.Body...)
+}
+
+// Add functions of top-level `defun' forms to funcs, returns the other forms in order.
+// `defun' forms may be the body of top-level `let' or `let*', then they see its bindings.
+// functions are looked up in funcs when called, so they can call each other and themselves.
+// names already in funcs can not be defined, funcs should not be shared like StandartLogicFunctions
+func RegisterFunctions(funcs *FunctionMap, program []Statement) ([]Statement, error) {
+	var rest []Statement
+	for _, form := range program {
+		e := form.ValueExpression()
+		if isDefun(form) {
+			if err := defineFunction(funcs, form, nil); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if len(e) < 3 || e[0].Quoted() || e[0].ValueString() != "let" && e[0].ValueString() != "let*" ||
+			e[1].Type() != STExpression || !slices.ContainsFunc(e[2:], isDefun) {
+			rest = append(rest, form)
+			continue
+		}
+		for _, def := range e[2:] {
+			if !isDefun(def) {
+				return nil, fmt.Errorf("%s: function `%s' around `defun' expect only `defun' forms", def.Pos(), e[0].ValueString())
+			}
+		}
+		var top Environment
+		scope, errStm := bindLet(funcs, &top, e[0].ValueString(), e[1].ValueExpression(), e[0].ValueString() == "let*")
+		if errStm != nil {
+			return nil, fmt.Errorf("%s: %w", errStm.Pos(), errStm.ValueError())
+		}
+		for _, def := range e[2:] {
+			if err := defineFunction(funcs, def, scope); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rest, nil
+}
+
+func isDefun(s Statement) bool {
+	e := s.ValueExpression()
+	return len(e) > 0 && !e[0].Quoted() && e[0].ValueString() == "defun"
+}
+
+// Add function of (defun name (params...) body...) form to funcs, scope is bindings of `let' around it
+func defineFunction(funcs *FunctionMap, form Statement, scope Environment) error {
+	expr := form.ValueExpression()[1:]
+	if len(expr) == 0 || !isBindingName(expr[0]) {
+		return fmt.Errorf("%s: function `defun' expect function name", form.Pos())
+	}
+	name := expr[0].ValueString()
+	if _, ok := (*funcs)[name]; ok || coreForms[name] {
+		return fmt.Errorf("%s: function `defun' can not redefine `%s'", form.Pos(), name)
+	}
+	f, err := newLambda("defun", expr[1:])
+	if err != nil {
+		return fmt.Errorf("%s: %w", form.Pos(), err)
+	}
+	f.Name, f.Env = name, scope
+	if *funcs == nil {
+		*funcs = make(FunctionMap)
+	}
+	(*funcs)[name] = f.Call
+	return nil
+}
+
+// Is it name of function bound by `let' or given in environment
+func envFunction(env *Environment, name string) (*Lambda, bool) {
+	v, ok := (*env).Get(name)
+	if !ok || v.Type() != STFunction {
+		return nil, false
+	}
+	return v.ValueFunction(), true
+}
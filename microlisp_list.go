@@ -0,0 +1,154 @@
+package microlisp
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// List functions, all params are evaluated.
+// lists are never changed in place, append and reverse give new lists
+var ListFunctions = FunctionMap{
+	"list": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		res := make([]Statement, len(expr))
+		for i := range expr {
+			res[i] = Eval(funcs, env, &expr[i])
+			if res[i].Type() == STError {
+				return res[i]
+			}
+		}
+		return NewListStatement(res)
+	},
+	"first": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("first", funcs, env, expr, 1, STList)
+		if errStm != nil {
+			return *errStm
+		}
+		if len(args[0].ValueList()) == 0 {
+			return NewErrorStatement(fmt.Errorf("function `first' got empty list"))
+		}
+		return args[0].ValueList()[0]
+	},
+	// list without the first element, empty list for empty list
+	"rest": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("rest", funcs, env, expr, 1, STList)
+		if errStm != nil {
+			return *errStm
+		}
+		l := args[0].ValueList()
+		if len(l) == 0 {
+			return args[0]
+		}
+		return NewListStatement(l[1:len(l):len(l)])
+	},
+	// (nth list i), i is zero-based
+	"nth": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("nth", funcs, env, expr, 2, STList, STInt)
+		if errStm != nil {
+			return *errStm
+		}
+		l, i := args[0].ValueList(), args[1].ValueInt()
+		if i < 0 || i >= int64(len(l)) {
+			return NewErrorStatement(fmt.Errorf("function `nth' index %d out of length %d", i, len(l)))
+		}
+		return l[i]
+	},
+	// length of list, string (in runes) or float array
+	"len": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := listParams("len", funcs, env, expr, 1)
+		if errStm != nil {
+			return *errStm
+		}
+		switch v := args[0]; v.Type() {
+		case STList:
+			return NewIntStatement(int64(len(v.ValueList())))
+		case STString:
+			return NewIntStatement(int64(utf8.RuneCountInString(v.ValueString())))
+		case STFloatArray:
+			return NewIntStatement(int64(len(v.ValueFloatArray())))
+		}
+		return NewErrorStatement(fmt.Errorf("function `len' expect list, string or float array param"))
+	},
+	// (append list x...) gives list with values added to the end
+	"append": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		if len(expr) == 0 {
+			return NewErrorStatement(fmt.Errorf("function `append' required at least one param"))
+		}
+		args, errStm := listParams("append", funcs, env, expr, len(expr))
+		if errStm != nil {
+			return *errStm
+		}
+		if args[0].Type() != STList {
+			return NewErrorStatement(fmt.Errorf("function `append' expect list param"))
+		}
+		l := args[0].ValueList()
+		res := make([]Statement, 0, len(l)+len(args)-1)
+		return NewListStatement(append(append(res, l...), args[1:]...))
+	},
+	"reverse": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("reverse", funcs, env, expr, 1, STList)
+		if errStm != nil {
+			return *errStm
+		}
+		l := args[0].ValueList()
+		res := make([]Statement, len(l))
+		for i := range l {
+			res[len(l)-1-i] = l[i]
+		}
+		return NewListStatement(res)
+	},
+	// (contains? list x) compares values with CompareStatements,
+	// (contains? str sub) looks for substring as in StringFunctions
+	"contains?": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := listParams("contains?", funcs, env, expr, 2)
+		if errStm != nil {
+			return *errStm
+		}
+		if args[0].Type() == STString && args[1].Type() == STString {
+			return NewBoolStatement(strings.Contains(args[0].ValueString(), args[1].ValueString()))
+		}
+		if args[0].Type() != STList {
+			return NewErrorStatement(fmt.Errorf("function `contains?' expect list param"))
+		}
+		return NewBoolStatement(indexOf(args[0].ValueList(), args[1]) >= 0)
+	},
+	// (index-of list x) gives index of the first equal value, -1 if none
+	"index-of": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := listParams("index-of", funcs, env, expr, 2)
+		if errStm != nil {
+			return *errStm
+		}
+		if args[0].Type() != STList {
+			return NewErrorStatement(fmt.Errorf("function `index-of' expect list param"))
+		}
+		return NewIntStatement(int64(indexOf(args[0].ValueList(), args[1])))
+	},
+}
+
+// Evaluate exactly n params of any type
+func listParams(name string, funcs *FunctionMap, env *Environment, expr []Statement, n int) ([]Statement, *Statement) {
+	if len(expr) != n {
+		err := NewErrorStatement(fmt.Errorf("function `%s' required %d param", name, n))
+		if n == 1 {
+			err = NewErrorStatement(fmt.Errorf("function `%s' required one param", name))
+		}
+		return nil, &err
+	}
+	args := make([]Statement, len(expr))
+	for i := range expr {
+		args[i] = Eval(funcs, env, &expr[i])
+		if args[i].Type() == STError {
+			return nil, &args[i]
+		}
+	}
+	return args, nil
+}
+
+func indexOf(l []Statement, x Statement) int {
+	for i := range l {
+		if CompareStatements(l[i], x) == 0 {
+			return i
+		}
+	}
+	return -1
+}
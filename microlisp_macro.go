@@ -0,0 +1,391 @@
+package microlisp
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Macro defined by (defmacro name (params... &rest name) body...)
+// body is evaluated at expansion time with params bound to unevaluated argument forms,
+// &rest param is bound to list of the remaining forms, result replaces the macro call.
+// hygiene is partial: names bound by let, let* and lambda in quasiquote templates of body
+// are renamed on every expansion (tmp becomes tmp#1) in binding positions, `!tmp' and
+// (env tmp) references and function calls, so they never capture names used in arguments.
+// free references of templates, like !rate not bound in the template, are looked up
+// where the expansion is evaluated, so `let' of the caller around the macro call shadows them
+type Macro struct {
+	Name   string
+	Params []string
+	Rest   string // name of &rest param, empty if none
+	Body   []Statement
+}
+
+// Macros by name
+type MacroMap map[string]*Macro
+
+// Limit of nested macro expansions
+const MaxExpandDepth = 1000
+
+var ErrorExpandDepth = fmt.Errorf("macro expansion depth limit exceeded")
+
+// Add macro of `defmacro' form
+func (macros MacroMap) Define(form Statement) error {
+	e := form.ValueExpression()
+	if len(e) == 0 || e[0].ValueString() != "defmacro" {
+		return fmt.Errorf("%s: expect defmacro form", form.Pos())
+	}
+	if len(e) < 4 || !isBindingName(e[1]) || e[2].Type() != STExpression {
+		return fmt.Errorf("%s: function `defmacro' expect name, list of params and body", form.Pos())
+	}
+	m := &Macro{Name: e[1].ValueString(), Body: e[3:]}
+	if coreForms[m.Name] {
+		return fmt.Errorf("%s: function `defmacro' can not redefine `%s'", form.Pos(), m.Name)
+	}
+	params := e[2].ValueExpression()
+	for i := 0; i < len(params); i++ {
+		if !isBindingName(params[i]) {
+			return fmt.Errorf("%s: function `defmacro' expect param name", form.Pos())
+		}
+		if params[i].ValueString() != "&rest" {
+			m.Params = append(m.Params, params[i].ValueString())
+			continue
+		}
+		if i != len(params)-2 || !isBindingName(params[i+1]) {
+			return fmt.Errorf("%s: function `defmacro' expect one param after &rest", form.Pos())
+		}
+		m.Rest = params[i+1].ValueString()
+		break
+	}
+	macros[m.Name] = m
+	return nil
+}
+
+// Expand macros of program: top-level `defmacro' forms are added to macros and removed,
+// macro calls in the other forms are expanded, macro bodies are evaluated with funcs
+func ExpandProgram(funcs *FunctionMap, macros MacroMap, program []Statement) ([]Statement, error) {
+	x := &expander{funcs: funcs, macros: macros}
+	res := make([]Statement, 0, len(program))
+	for _, form := range program {
+		if e := form.ValueExpression(); len(e) > 0 && e[0].ValueString() == "defmacro" {
+			if err := macros.Define(form); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		form, err := x.expand(form, 0)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, form)
+	}
+	return res, nil
+}
+
+// Statement with all macro calls expanded, forms inside quote are kept as is
+func MacroExpand(funcs *FunctionMap, macros MacroMap, stm Statement) (Statement, error) {
+	x := &expander{funcs: funcs, macros: macros}
+	return x.expand(stm, 0)
+}
+
+type expander struct {
+	funcs  *FunctionMap
+	macros MacroMap
+	count  int // number of expansions, it makes renamed names unique
+}
+
+func (x *expander) expand(stm Statement, depth int) (Statement, error) {
+	e := stm.ValueExpression()
+	if stm.Type() != STExpression || len(e) == 0 {
+		return stm, nil
+	}
+	if depth > MaxExpandDepth {
+		return Statement{}, fmt.Errorf("%s: %w", stm.Pos(), ErrorExpandDepth)
+	}
+	name := e[0].ValueString()
+	if m, ok := x.macros[name]; ok && !e[0].Quoted() {
+		res, err := x.apply(m, e[1:])
+		if err != nil {
+			return Statement{}, fmt.Errorf("%s: macro `%s' %w", stm.Pos(), name, err)
+		}
+		if !res.Pos().IsValid() && stm.Pos().IsValid() {
+			res.setPos(stm.Pos())
+		}
+		return x.expand(res, depth+1)
+	}
+	// forms which are not evaluated: quoted data, names and params of bindings
+	from := 1
+	switch name {
+	case "quote", "defmacro":
+		return stm, nil
+	case "lambda":
+		from = 2
+	case "defun":
+		from = 3
+	}
+	res := make([]Statement, len(e))
+	copy(res, e[:min(from, len(e))])
+	for i := from; i < len(e); i++ {
+		var err error
+		if i == 1 && (name == "let" || name == "let*") && e[1].Type() == STExpression {
+			res[i], err = x.expandBindings(e[1], depth)
+		} else {
+			res[i], err = x.expand(e[i], depth)
+		}
+		if err != nil {
+			return Statement{}, err
+		}
+	}
+	stm.Value = res
+	return stm, nil
+}
+
+// Expand values of (name value) bindings of `let'
+func (x *expander) expandBindings(stm Statement, depth int) (Statement, error) {
+	bindings := stm.ValueExpression()
+	res := make([]Statement, len(bindings))
+	for i, b := range bindings {
+		res[i] = b
+		if pair := b.ValueExpression(); len(pair) == 2 {
+			v, err := x.expand(pair[1], depth)
+			if err != nil {
+				return Statement{}, err
+			}
+			res[i].Value = []Statement{pair[0], v}
+		}
+	}
+	stm.Value = res
+	return stm, nil
+}
+
+func (x *expander) apply(m *Macro, args []Statement) (Statement, error) {
+	if len(args) < len(m.Params) || m.Rest == "" && len(args) > len(m.Params) {
+		if m.Rest != "" {
+			return Statement{}, fmt.Errorf("required at least %d param", len(m.Params))
+		}
+		return Statement{}, fmt.Errorf("required %d param", len(m.Params))
+	}
+	scope := NewEnvironment()
+	for i, p := range m.Params {
+		scope[p] = args[i]
+	}
+	if m.Rest != "" {
+		scope[m.Rest] = NewListStatement(args[len(m.Params):])
+	}
+	x.count++
+	body := renameTemplates(m.Body, "#"+strconv.Itoa(x.count))
+	res := EvalProgram(x.funcs, &scope, body)
+	if res.Type() == STError {
+		return Statement{}, res.ValueError()
+	}
+	return res, nil
+}
+
+// Rename names bound by let, let* and lambda inside quasiquote templates of body
+func renameTemplates(body []Statement, suffix string) []Statement {
+	names := make(map[string]bool)
+	for _, s := range body {
+		walkTemplate(s, 0, func(s Statement) Statement {
+			e := s.ValueExpression()
+			if len(e) < 2 || e[1].Type() != STExpression {
+				return s
+			}
+			switch e[0].ValueString() {
+			case "let", "let*":
+				for _, b := range e[1].ValueExpression() {
+					if pair := b.ValueExpression(); len(pair) == 2 && isBindingName(pair[0]) {
+						names[pair[0].ValueString()] = true
+					}
+				}
+			case "lambda":
+				for _, p := range e[1].ValueExpression() {
+					if isBindingName(p) {
+						names[p.ValueString()] = true
+					}
+				}
+			}
+			return s
+		})
+	}
+	if len(names) == 0 {
+		return body
+	}
+	res := make([]Statement, len(body))
+	for i, s := range body {
+		res[i] = renameTemplate(s, 0, names, suffix)
+	}
+	return res
+}
+
+// Rename names inside quasiquote templates of s: `env' references, function calls,
+// names bound by let, let* and lambda; other atoms are data and quoted forms are kept
+func renameTemplate(s Statement, level int, names map[string]bool, suffix string) Statement {
+	rename := func(s Statement) Statement {
+		if s.Type() == STString && !s.Quoted() {
+			s.Value = renameAtom(s.ValueString(), names, suffix)
+		}
+		return s
+	}
+	e := s.ValueExpression()
+	if s.Type() != STExpression {
+		if level > 0 && strings.HasPrefix(s.ValueString(), "!") {
+			return rename(s)
+		}
+		return s
+	}
+	head := ""
+	if len(e) > 0 && !e[0].Quoted() {
+		head = e[0].ValueString()
+	}
+	switch head {
+	case "quote":
+		if level > 0 {
+			return s
+		}
+	case "quasiquote":
+		level++
+	case "unquote", "unquote-splicing":
+		level--
+	}
+	res := make([]Statement, len(e))
+	for i := range e {
+		res[i] = renameTemplate(e[i], level, names, suffix)
+	}
+	if level > 0 && len(res) > 0 {
+		res[0] = rename(res[0])
+		switch {
+		case len(res) < 2:
+		case head == "env" || head == "has-env":
+			res[1] = rename(res[1])
+		case (head == "let" || head == "let*") && res[1].Type() == STExpression:
+			bindings := slices.Clone(res[1].ValueExpression())
+			for j, b := range bindings {
+				if pair := b.ValueExpression(); len(pair) == 2 {
+					b.Value = []Statement{rename(pair[0]), pair[1]}
+					bindings[j] = b
+				}
+			}
+			res[1].Value = bindings
+		case head == "lambda" && res[1].Type() == STExpression:
+			params := slices.Clone(res[1].ValueExpression())
+			for j := range params {
+				params[j] = rename(params[j])
+			}
+			res[1].Value = params
+		}
+	}
+	s.Value = res
+	return s
+}
+
+// Apply fn to parts of quasiquote templates, which are not unquoted,
+// level is the number of quasiquotes around s
+func walkTemplate(s Statement, level int, fn func(Statement) Statement) Statement {
+	e := s.ValueExpression()
+	if s.Type() != STExpression {
+		if level > 0 {
+			return fn(s)
+		}
+		return s
+	}
+	if len(e) > 0 && !e[0].Quoted() {
+		switch e[0].ValueString() {
+		case "quasiquote":
+			level++
+		case "unquote", "unquote-splicing":
+			level--
+		}
+	}
+	if level > 0 {
+		s = fn(s)
+	}
+	res := make([]Statement, len(e))
+	for i := range e {
+		res[i] = walkTemplate(e[i], level, fn)
+	}
+	s.Value = res
+	return s
+}
+
+// Renamed name or `env' reference to it: tmp, !tmp, !tmp?, !tmp.a, !tmp[0]
+func renameAtom(atom string, names map[string]bool, suffix string) string {
+	key := strings.TrimPrefix(atom, "!")
+	end := strings.IndexAny(key, ".[")
+	if end < 0 {
+		end = len(key)
+		if len(key) < len(atom) && strings.HasSuffix(key, "?") && !names[key] {
+			end--
+		}
+	}
+	if !names[key[:end]] {
+		return atom
+	}
+	return atom[:len(atom)-len(key)] + key[:end] + suffix + key[end:]
+}
+
+// `quasiquote' form: template with (unquote x) replaced by value of x
+// and (unquote-splicing x) by elements of list x
+func Quasiquote(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+	if len(expr) != 1 {
+		return NewErrorStatement(fmt.Errorf("function `quasiquote' required one param"))
+	}
+	return quasiquote(funcs, env, expr[0], 1)
+}
+
+func quasiquote(funcs *FunctionMap, env *Environment, s Statement, level int) Statement {
+	e := s.ValueExpression()
+	if s.Type() != STExpression || len(e) == 0 {
+		return s
+	}
+	switch e[0].ValueString() {
+	case "quasiquote":
+		level++
+	case "unquote", "unquote-splicing":
+		if level > 1 {
+			level--
+			break
+		}
+		if len(e) != 2 {
+			return NewErrorStatement(fmt.Errorf("function `%s' required one param", e[0].ValueString()))
+		}
+		if e[0].ValueString() == "unquote-splicing" {
+			return NewErrorStatement(fmt.Errorf("function `unquote-splicing' expect to be inside list"))
+		}
+		return unquoteValue(funcs, env, e[1])
+	}
+	res := make([]Statement, 0, len(e))
+	for _, x := range e {
+		if xe := x.ValueExpression(); level == 1 && len(xe) == 2 && xe[0].ValueString() == "unquote-splicing" {
+			v := unquoteValue(funcs, env, xe[1])
+			switch v.Type() {
+			case STError:
+				return v
+			case STList:
+				res = append(res, v.ValueList()...)
+			case STExpression:
+				res = append(res, v.ValueExpression()...)
+			default:
+				return NewErrorStatement(fmt.Errorf("function `unquote-splicing' expect list param"))
+			}
+			continue
+		}
+		v := quasiquote(funcs, env, x, level)
+		if v.Type() == STError {
+			return v
+		}
+		res = append(res, v)
+	}
+	s.Value = res
+	return s
+}
+
+// Value of unquoted form: bound name gives its value (,x is the same as ,!x), other forms are evaluated
+func unquoteValue(funcs *FunctionMap, env *Environment, s Statement) Statement {
+	if s.Type() == STString && !s.Quoted() {
+		if v, ok := (*env).Get(s.ValueString()); ok {
+			return v
+		}
+	}
+	return Eval(funcs, env, &s)
+}
@@ -0,0 +1,132 @@
+package microlisp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Map functions, all params are evaluated.
+// maps are looked up by string keys, lists by int indexes
+var MapFunctions = FunctionMap{
+	// (hash-map k1 v1 k2 v2 ...) with string keys
+	"hash-map": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		if len(expr)%2 != 0 {
+			return NewErrorStatement(fmt.Errorf("function `hash-map' required even number of param"))
+		}
+		args, errStm := listParams("hash-map", funcs, env, expr, len(expr))
+		if errStm != nil {
+			return *errStm
+		}
+		res := make(map[string]Statement, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			if args[i].Type() != STString {
+				return NewErrorStatement(fmt.Errorf("function `hash-map' expect string key"))
+			}
+			res[args[i].ValueString()] = args[i+1]
+		}
+		return NewMapStatement(res)
+	},
+	// (get m key) or (get m key default), default is given for missing key
+	"get": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		if len(expr) != 2 && len(expr) != 3 {
+			return NewErrorStatement(fmt.Errorf("function `get' required 2 or 3 param"))
+		}
+		args, errStm := listParams("get", funcs, env, expr, len(expr))
+		if errStm != nil {
+			return *errStm
+		}
+		v, err := getChild(args[0], args[1])
+		if errors.Is(err, errMissingKey) && len(args) == 3 {
+			return args[2]
+		}
+		if err != nil {
+			return NewErrorStatement(fmt.Errorf("function `get' %w", err))
+		}
+		return v
+	},
+	// (get-in m k1 k2 ...) looks up nested maps and lists
+	"get-in": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		if len(expr) < 2 {
+			return NewErrorStatement(fmt.Errorf("function `get-in' required at least 2 param"))
+		}
+		args, errStm := listParams("get-in", funcs, env, expr, len(expr))
+		if errStm != nil {
+			return *errStm
+		}
+		v := args[0]
+		for _, key := range args[1:] {
+			var err error
+			if v, err = getChild(v, key); err != nil {
+				return NewErrorStatement(fmt.Errorf("function `get-in' %w", err))
+			}
+		}
+		return v
+	},
+	// sorted list of keys
+	"keys": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("keys", funcs, env, expr, 1, STMap)
+		if errStm != nil {
+			return *errStm
+		}
+		keys := mapKeys(args[0].ValueMap())
+		res := make([]Statement, len(keys))
+		for i, k := range keys {
+			res[i] = NewStringStatement(k)
+		}
+		return NewListStatement(res)
+	},
+	// (has? m key) is true if map has key or list has index
+	"has?": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := listParams("has?", funcs, env, expr, 2)
+		if errStm != nil {
+			return *errStm
+		}
+		_, err := getChild(args[0], args[1])
+		if err != nil && !errors.Is(err, errMissingKey) {
+			return NewErrorStatement(fmt.Errorf("function `has?' %w", err))
+		}
+		return NewBoolStatement(err == nil)
+	},
+}
+
+var errMissingKey = fmt.Errorf("key not found")
+var errWrongKey = fmt.Errorf("expect string key for map and int index for list")
+
+// Value of map by string key or of list by int index
+func getChild(v Statement, key Statement) (Statement, error) {
+	switch {
+	case v.Type() == STMap && key.Type() == STString:
+		if res, ok := v.ValueMap()[key.ValueString()]; ok {
+			return res, nil
+		}
+		return Statement{}, fmt.Errorf("%w: %s", errMissingKey, key.ValueString())
+	case v.Type() == STList && key.Type() == STInt:
+		l, i := v.ValueList(), key.ValueInt()
+		if i >= 0 && i < int64(len(l)) {
+			return l[i], nil
+		}
+		return Statement{}, fmt.Errorf("%w: %d", errMissingKey, i)
+	case v.Type() == STMap || v.Type() == STList:
+		return Statement{}, errWrongKey
+	}
+	return Statement{}, fmt.Errorf("expect map or list")
+}
+
+func mapKeys(m map[string]Statement) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Keys and values of map sorted by key: k1 v1 k2 v2 ...
+func mapPairs(m map[string]Statement) []Statement {
+	res := make([]Statement, 0, 2*len(m))
+	for _, k := range mapKeys(m) {
+		res = append(res, NewStringStatement(k), m[k])
+	}
+	return res
+}
@@ -0,0 +1,206 @@
+package microlisp
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Pretty printer, after Wadler's "A prettier printer":
+// an expression is written in one line when it fits into width,
+// otherwise its arguments go on separate lines indented by two spaces.
+// source comments are kept, each on its own line except the ones written
+// at the end of statement line, they stay there. literals are printed as written in source
+func Pretty(s Statement, width int) string {
+	d, _ := statementDoc(s, false)
+	return layout(d, width)
+}
+
+// Pretty print top-level forms separated by blank lines
+func PrettyProgram(program []Statement, width int) string {
+	var b strings.Builder
+	for i, s := range program {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(Pretty(s, width))
+	}
+	if len(program) > 0 {
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Document algebra
+type doc interface{}
+
+type docText string
+
+type docLine struct {
+	hard bool // newline even in flat mode
+}
+
+type docNest struct {
+	indent int
+	d      doc
+}
+
+type docGroup struct {
+	d doc
+}
+
+type docConcat []doc
+
+var softLine, hardLine = docLine{false}, docLine{true}
+
+// Document for statement with its comments, reports if it ends with a line comment
+func statementDoc(s Statement, head bool) (doc, bool) {
+	var res docConcat
+	for _, c := range s.Comments() {
+		res = append(res, docText(c.Text), hardLine)
+	}
+	lineComment := false
+	if prefix := quotePrefix(s.ValueExpression()); s.Type() == STExpression && prefix != "" {
+		var d doc
+		d, lineComment = statementDoc(s.ValueExpression()[1], false)
+		res = append(res, docText(prefix), d)
+	} else if s.Type() == STExpression {
+		res = append(res, expressionDoc(s.ValueExpression()))
+	} else if s.Type() == STList {
+		res = append(res, expressionDoc(dataExpression("list", s.ValueList())))
+	} else if s.Type() == STMap {
+		res = append(res, expressionDoc(dataExpression("hash-map", mapPairs(s.ValueMap()))))
+	} else if s.Type() == STFunction {
+		res = append(res, expressionDoc(s.ValueFunction().expression()))
+	} else if text := s.sourceText(); text != "" {
+		res = append(res, docText(text))
+	} else {
+		var b strings.Builder
+		writeStatement(&b, s, head)
+		res = append(res, docText(b.String()))
+	}
+	for _, c := range s.Trailing() {
+		if c.Inline && !lineComment {
+			res = append(res, docText(" "+c.Text))
+		} else {
+			res = append(res, hardLine, docText(c.Text))
+		}
+		lineComment = strings.HasPrefix(c.Text, ";")
+	}
+	return res, lineComment
+}
+
+// (name elements...) expression which evaluates to list or map of elements
+func dataExpression(name string, elements []Statement) []Statement {
+	res := make([]Statement, 0, len(elements)+1)
+	res = append(res, NewStringStatement(name))
+	for _, e := range elements {
+		res = append(res, dataElement(e))
+	}
+	return res
+}
+
+func expressionDoc(e []Statement) doc {
+	if len(e) == 0 {
+		return docText("()")
+	}
+	var args docConcat
+	head, lineComment := statementDoc(e[0], true)
+	for _, x := range e[1:] {
+		sep := softLine
+		if lineComment { // the next argument must not be commented out
+			sep = hardLine
+		}
+		var d doc
+		d, lineComment = statementDoc(x, false)
+		args = append(args, sep, d)
+	}
+	res := docConcat{docText("("), head, docNest{2, args}}
+	if lineComment { // `)' must not be commented out
+		res = append(res, hardLine)
+	}
+	return docGroup{append(res, docText(")"))}
+}
+
+type docCmd struct {
+	indent int
+	flat   bool
+	d      doc
+}
+
+func layout(d doc, width int) string {
+	var b strings.Builder
+	col := 0
+	stack := []docCmd{{0, false, d}}
+	for len(stack) > 0 {
+		cmd := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		switch d := cmd.d.(type) {
+		case docText:
+			b.WriteString(string(d))
+			if i := strings.LastIndexByte(string(d), '\n'); i >= 0 {
+				col = utf8.RuneCountInString(string(d[i+1:]))
+			} else {
+				col += utf8.RuneCountInString(string(d))
+			}
+		case docLine:
+			if cmd.flat && !d.hard {
+				b.WriteByte(' ')
+				col++
+			} else {
+				b.WriteByte('\n')
+				b.WriteString(strings.Repeat(" ", cmd.indent))
+				col = cmd.indent
+			}
+		case docNest:
+			stack = append(stack, docCmd{cmd.indent + d.indent, cmd.flat, d.d})
+		case docConcat:
+			for i := len(d) - 1; i >= 0; i-- {
+				stack = append(stack, docCmd{cmd.indent, cmd.flat, d[i]})
+			}
+		case docGroup:
+			flat := cmd.flat || fits(width-col, docCmd{cmd.indent, true, d.d}, stack)
+			stack = append(stack, docCmd{cmd.indent, flat, d.d})
+		}
+	}
+	return b.String()
+}
+
+// Does next, followed by the rest of layout stack, fit into rest columns up to the next line break
+func fits(rest int, next docCmd, stack []docCmd) bool {
+	local := []docCmd{next}
+	for rest >= 0 {
+		if len(local) == 0 {
+			if len(stack) == 0 {
+				return true
+			}
+			local = append(local, stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		}
+		cmd := local[len(local)-1]
+		local = local[:len(local)-1]
+		switch d := cmd.d.(type) {
+		case docText:
+			if strings.ContainsRune(string(d), '\n') {
+				return !cmd.flat
+			}
+			rest -= utf8.RuneCountInString(string(d))
+		case docLine:
+			if !cmd.flat {
+				return true
+			}
+			if d.hard {
+				return false
+			}
+			rest--
+		case docNest:
+			local = append(local, docCmd{cmd.indent + d.indent, cmd.flat, d.d})
+		case docConcat:
+			for i := len(d) - 1; i >= 0; i-- {
+				local = append(local, docCmd{cmd.indent, cmd.flat, d[i]})
+			}
+		case docGroup:
+			local = append(local, docCmd{cmd.indent, cmd.flat, d.d})
+		}
+	}
+	return false
+}
@@ -0,0 +1,425 @@
+package microlisp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"unicode/utf8"
+)
+
+// Streaming reader of forms, like json.Decoder:
+//
+//	dec := NewDecoder(r)
+//	for {
+//		stm, err := dec.Decode()
+//		if err == io.EOF {
+//			break
+//		}
+//		...
+//	}
+//
+// comments after the last form are dropped, except the ones on its last line
+type Decoder struct {
+	s       *scanner
+	pending Tokens // tokens read ahead by More
+	err     error  // sticky error
+	opts    ParseOptions
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{s: newScanner(r)}
+}
+
+// Read float atoms as float64 instead of float32
+func (d *Decoder) UseFloat64() {
+	d.opts.Float64 = true
+}
+
+// More reports whether there is another form in the input
+func (d *Decoder) More() bool {
+	for {
+		if len(d.pending) > 0 && d.pending[len(d.pending)-1].typ != commentToken {
+			return true
+		}
+		if d.err != nil {
+			return false
+		}
+		tok, err := d.s.scan()
+		if err != nil {
+			d.err = err
+			return err != io.EOF
+		}
+		d.pending = append(d.pending, tok)
+	}
+}
+
+func (d *Decoder) next() (*Token, error) {
+	if len(d.pending) > 0 {
+		tok := d.pending[0]
+		d.pending = d.pending[1:]
+		return tok, nil
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	tok, err := d.s.scan()
+	if err != nil {
+		d.err = err
+	}
+	return tok, err
+}
+
+// Decode reads next top-level form, returns io.EOF when there are no more forms
+func (d *Decoder) Decode() (Statement, error) {
+	var tokens Tokens
+	depth := 0
+	quoted := false // quote token waits for its form
+	for {
+		tok, err := d.next()
+		if err == io.EOF && (depth > 0 || quoted) {
+			d.err = d.s.parseError(ErrorEndOfExpression, d.s.pos)
+			return Statement{}, d.err
+		}
+		if err != nil {
+			return Statement{}, err
+		}
+		tokens = append(tokens, tok)
+		if tok.typ == openToken || tok.typ == openBracketToken || tok.typ == openBraceToken {
+			depth++
+		}
+		if tok.typ == closeToken || tok.typ == closeBracketToken || tok.typ == closeBraceToken {
+			if depth == 0 {
+				d.err = d.s.parseError(ErrorExpectOpen, tok.pos)
+				return Statement{}, d.err
+			}
+			depth--
+		}
+		quoted = depth == 0 && (quoted || tok.typ == quoteToken)
+		if depth == 0 && tok.typ != commentToken && tok.typ != quoteToken {
+			break
+		}
+	}
+	// comments on the line where the form ends belong to it
+	for len(d.pending) > 0 || d.err == nil && d.s.lineCommentFollows() {
+		tok, err := d.next()
+		if err != nil {
+			break
+		}
+		if tok.typ != commentToken || tok.pos.Line != tokens[len(tokens)-1].end.Line {
+			d.pending = append(Tokens{tok}, d.pending...)
+			break
+		}
+		tokens = append(tokens, tok)
+	}
+	stm, pos, err := formFromTokens(tokens, 0, d.opts)
+	if err != nil {
+		d.err = d.s.parseError(err, tokens[pos].pos)
+		return Statement{}, d.err
+	}
+	return stm, nil
+}
+
+// Scanner of tokens over runes of input
+type scanner struct {
+	r       runeByteScanner
+	ch      rune         // current rune, -1 at end of input
+	size    int          // byte size of ch
+	raw     byte         // source byte when ch is utf8.RuneError from invalid input
+	pos     Position     // position of ch
+	line    []byte       // source from start of the line of current token, for error snippets
+	lineOff int          // offset of line[0]
+	lineCol int          // column of line[0]
+	lineNL  int          // index after the last newline in line, 0 if none
+	ahead   []sourceRune // runes after ch read by peek
+}
+
+type sourceRune struct {
+	ch   rune
+	size int
+	raw  byte
+}
+
+const maxSnippetLine = 4096
+
+type runeByteScanner interface {
+	io.RuneScanner
+	io.ByteReader
+}
+
+func newScanner(r io.Reader) *scanner {
+	rr, ok := r.(runeByteScanner)
+	if !ok {
+		rr = bufio.NewReader(r)
+	}
+	s := &scanner{r: rr, pos: Position{Line: 1, Column: 1}, lineCol: 1}
+	s.read()
+	return s
+}
+
+func (s *scanner) read() {
+	var next sourceRune
+	if len(s.ahead) > 0 {
+		next, s.ahead = s.ahead[0], s.ahead[1:]
+	} else {
+		next = s.readRune()
+	}
+	s.ch, s.size, s.raw = next.ch, next.size, next.raw
+}
+
+func (s *scanner) readRune() sourceRune {
+	r, size, err := s.r.ReadRune()
+	if err != nil {
+		return sourceRune{ch: -1}
+	}
+	var raw byte
+	if r == utf8.RuneError && size == 1 { // keep invalid bytes as is
+		s.r.UnreadRune()
+		raw, _ = s.r.ReadByte()
+	}
+	return sourceRune{r, size, raw}
+}
+
+// Rune i+1 places after the current one, -1 at end of input, input is not consumed
+func (s *scanner) peek(i int) rune {
+	for len(s.ahead) <= i {
+		next := s.readRune()
+		if next.ch < 0 {
+			return -1
+		}
+		s.ahead = append(s.ahead, next)
+	}
+	return s.ahead[i].ch
+}
+
+// Move to the next rune
+func (s *scanner) nextRune() {
+	if s.ch < 0 {
+		return
+	}
+	if s.ch < utf8.RuneSelf {
+		s.line = append(s.line, byte(s.ch))
+	} else if s.ch == utf8.RuneError && s.size == 1 {
+		s.line = append(s.line, s.raw)
+	} else {
+		s.line = utf8.AppendRune(s.line, s.ch)
+	}
+	s.pos.Offset += s.size
+	if s.ch == '\n' {
+		s.lineNL = len(s.line)
+		s.pos.Line++
+		s.pos.Column = 1
+	} else {
+		s.pos.Column++
+	}
+	s.read()
+}
+
+// Forget lines before the current one, keep only tail of a long line
+func (s *scanner) trimLine() {
+	if s.lineNL > 0 {
+		s.lineOff += s.lineNL
+		s.lineCol = 1
+		s.line = append(s.line[:0], s.line[s.lineNL:]...)
+		s.lineNL = 0
+	}
+	if len(s.line) > maxSnippetLine {
+		cut := len(s.line) - maxSnippetLine/2
+		for cut < len(s.line) && !utf8.RuneStart(s.line[cut]) {
+			cut++
+		}
+		s.lineOff += cut
+		s.lineCol += utf8.RuneCount(s.line[:cut])
+		s.line = append(s.line[:0], s.line[cut:]...)
+		s.lineNL = 0
+	}
+}
+
+func isSpace(ch rune) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f'
+}
+
+func isAtomRune(ch rune) bool {
+	switch ch {
+	case '(', ')', '"', ';', '[', ']', '{', '}':
+		return false
+	}
+	return ch >= 0 && !isSpace(ch)
+}
+
+// Next token, io.EOF at end of input
+func (s *scanner) scan() (*Token, error) {
+	tok, err := s.scanToken()
+	if tok != nil {
+		tok.end = s.pos
+	}
+	return tok, err
+}
+
+// Skip spaces up to the end of line, reports if a comment may follow on this line
+func (s *scanner) lineCommentFollows() bool {
+	for isSpace(s.ch) && s.ch != '\n' {
+		s.nextRune()
+	}
+	return s.ch == ';' || s.ch == '#'
+}
+
+func (s *scanner) scanToken() (*Token, error) {
+	for isSpace(s.ch) {
+		s.nextRune()
+	}
+	s.trimLine()
+	if s.ch < 0 {
+		return nil, io.EOF
+	}
+	start := s.pos
+	switch s.ch {
+	case '(':
+		s.nextRune()
+		return &Token{typ: openToken, val: "(", pos: start}, nil
+	case ')':
+		s.nextRune()
+		return &Token{typ: closeToken, val: ")", pos: start}, nil
+	case '[':
+		s.nextRune()
+		return &Token{typ: openBracketToken, val: "[", pos: start}, nil
+	case ']':
+		s.nextRune()
+		return &Token{typ: closeBracketToken, val: "]", pos: start}, nil
+	case '{':
+		s.nextRune()
+		return &Token{typ: openBraceToken, val: "{", pos: start}, nil
+	case '}':
+		s.nextRune()
+		return &Token{typ: closeBraceToken, val: "}", pos: start}, nil
+	case '"':
+		return s.scanString(start)
+	case ';':
+		for s.ch >= 0 && s.ch != '\n' {
+			s.nextRune()
+		}
+		return &Token{typ: commentToken, val: s.text(start), pos: start}, nil
+	case '#':
+		s.nextRune()
+		if s.ch == '|' {
+			return s.scanBlockComment(start)
+		}
+	case '\'':
+		s.nextRune()
+		return &Token{typ: quoteToken, val: "quote", pos: start}, nil
+	case '`':
+		s.nextRune()
+		return &Token{typ: quoteToken, val: "quasiquote", pos: start}, nil
+	case ',':
+		s.nextRune()
+		if s.ch == '@' {
+			s.nextRune()
+			return &Token{typ: quoteToken, val: "unquote-splicing", pos: start}, nil
+		}
+		return &Token{typ: quoteToken, val: "unquote", pos: start}, nil
+	}
+	for isAtomRune(s.ch) || s.ch == '[' && s.pos != start && s.scanAtomIndex() {
+		s.nextRune()
+	}
+	return &Token{typ: atomToken, val: s.text(start), pos: start}, nil
+}
+
+// Index part of env path inside atom, like [0] or ["a.b"] in !orders[0]["a.b"],
+// if it follows `[', which is current, moves to its closing `]' and reports true,
+// otherwise keeps position, so `[' starts a float array: a[1 2] is a and [1 2]
+func (s *scanner) scanAtomIndex() bool {
+	i := 0
+	for ch := s.peek(i); ch != ']'; ch = s.peek(i) {
+		if ch < 0 || isSpace(ch) || ch == '(' || ch == ')' || ch == ';' {
+			return false
+		}
+		if ch == '"' {
+			i++
+			for ch = s.peek(i); ch >= 0 && ch != '"' && ch != '\n'; ch = s.peek(i) {
+				if ch == '\\' {
+					i++
+				}
+				i++
+			}
+			if ch != '"' {
+				return false
+			}
+		}
+		i++
+	}
+	for ; i >= 0; i-- {
+		s.nextRune()
+	}
+	return true
+}
+
+// Source text from start to the current rune
+func (s *scanner) text(start Position) string {
+	return string(s.line[start.Offset-s.lineOff:])
+}
+
+func (s *scanner) scanString(start Position) (*Token, error) {
+	s.nextRune()
+	for s.ch != '"' {
+		if s.ch < 0 {
+			return nil, s.parseError(ErrorUnterminatedString, start)
+		}
+		if s.ch == '\\' {
+			s.nextRune()
+			if s.ch < 0 {
+				return nil, s.parseError(ErrorUnterminatedString, start)
+			}
+		}
+		s.nextRune()
+	}
+	s.nextRune()
+	raw := s.text(start)
+	val, err := unescapeString(raw[1 : len(raw)-1])
+	if err != nil {
+		return nil, s.parseError(err, start)
+	}
+	return &Token{typ: stringToken, val: val, pos: start}, nil
+}
+
+// `#' is already read and `|' is current
+func (s *scanner) scanBlockComment(start Position) (*Token, error) {
+	s.nextRune()
+	depth := 1
+	for depth > 0 {
+		if s.ch < 0 {
+			return nil, s.parseError(ErrorUnterminatedComment, start)
+		}
+		prev := s.ch
+		s.nextRune()
+		if prev == '|' && s.ch == '#' {
+			depth--
+			s.nextRune()
+		} else if prev == '#' && s.ch == '|' {
+			depth++
+			s.nextRune()
+		}
+	}
+	return &Token{typ: commentToken, val: s.text(start), pos: start}, nil
+}
+
+// Parse error at pos, which is in the line of the current token or later
+func (s *scanner) parseError(err error, pos Position) *ParseError {
+	rel := pos.Offset - s.lineOff
+	if rel < 0 || rel > len(s.line) {
+		return &ParseError{Err: err, Pos: pos}
+	}
+	first := s.lineCol
+	begin := bytes.LastIndexByte(s.line[:rel], '\n') + 1
+	if begin > 0 {
+		first = 1
+	}
+	end := bytes.IndexByte(s.line[rel:], '\n')
+	if end < 0 { // complete the line for snippet
+		for s.ch >= 0 && s.ch != '\n' && len(s.line) < maxSnippetLine*2 {
+			s.nextRune()
+		}
+		end = len(s.line)
+	} else {
+		end += rel
+	}
+	return &ParseError{Err: err, Pos: pos, Line: string(s.line[begin:end]), first: first}
+}
@@ -0,0 +1,139 @@
+package microlisp
+
+import (
+	"container/list"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sync"
+)
+
+// Regular expression functions, patterns use RE2 syntax of package regexp.
+// compiled patterns are cached, patterns longer than MaxRegexpLength bytes
+// or compiled to more than MaxRegexpInsts instructions are rejected
+var RegexpFunctions = FunctionMap{
+	// (re-match pattern str) is true if pattern matches any part of str, use ^ and $ to match whole
+	"re-match": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		re, args, errStm := regexpParams("re-match", funcs, env, expr, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		return NewBoolStatement(re.MatchString(args[1].ValueString()))
+	},
+	// (re-find pattern str) gives the leftmost match, empty string if none
+	"re-find": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		re, args, errStm := regexpParams("re-find", funcs, env, expr, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		return NewStringStatement(re.FindString(args[1].ValueString()))
+	},
+	// (re-groups pattern str) gives list of the leftmost match and its groups, empty if none
+	"re-groups": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		re, args, errStm := regexpParams("re-groups", funcs, env, expr, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		groups := re.FindStringSubmatch(args[1].ValueString())
+		res := make([]Statement, len(groups))
+		for i, g := range groups {
+			res[i] = NewStringStatement(g)
+		}
+		return NewListStatement(res)
+	},
+	// (re-replace pattern str repl) replaces all matches, $1 or ${name} in repl are groups
+	"re-replace": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		re, args, errStm := regexpParams("re-replace", funcs, env, expr, STString, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		return NewStringStatement(re.ReplaceAllString(args[1].ValueString(), args[2].ValueString()))
+	},
+}
+
+const (
+	MaxRegexpLength = 1024
+	MaxRegexpInsts  = 10000
+	regexpCacheSize = 256
+)
+
+var ErrorRegexpTooLong = fmt.Errorf("pattern is too long")
+var ErrorRegexpTooComplex = fmt.Errorf("pattern is too complex")
+
+// Evaluate pattern and the rest params, pattern is compiled or taken from cache
+func regexpParams(name string, funcs *FunctionMap, env *Environment, expr []Statement,
+	types ...StatementType) (*regexp.Regexp, []Statement, *Statement) {
+	types = append([]StatementType{STString}, types...)
+	args, errStm := stringParams(name, funcs, env, expr, len(types), types...)
+	if errStm != nil {
+		return nil, nil, errStm
+	}
+	re, err := regexpCache.compile(args[0].ValueString())
+	if err != nil {
+		e := NewErrorStatement(fmt.Errorf("function `%s' %w", name, err))
+		return nil, nil, &e
+	}
+	return re, args, nil
+}
+
+// Check size limits and compile pattern
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > MaxRegexpLength {
+		return nil, ErrorRegexpTooLong
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	if len(prog.Inst) > MaxRegexpInsts {
+		return nil, ErrorRegexpTooComplex
+	}
+	return regexp.Compile(pattern)
+}
+
+// LRU cache of compiled patterns, failures are cached too
+type lruRegexpCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // of *regexpEntry, most recently used first
+	items map[string]*list.Element
+}
+
+type regexpEntry struct {
+	pattern string
+	re      *regexp.Regexp
+	err     error
+}
+
+var regexpCache = newRegexpCache(regexpCacheSize)
+
+func newRegexpCache(size int) *lruRegexpCache {
+	return &lruRegexpCache{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruRegexpCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	if el, ok := c.items[pattern]; ok {
+		c.order.MoveToFront(el)
+		e := el.Value.(*regexpEntry)
+		c.mu.Unlock()
+		return e.re, e.err
+	}
+	c.mu.Unlock()
+	re, err := compileRegexp(pattern) // outside of lock, may be done twice for the same pattern
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[pattern]; !ok {
+		c.items[pattern] = c.order.PushFront(&regexpEntry{pattern, re, err})
+		if c.order.Len() > c.size {
+			last := c.order.Back()
+			c.order.Remove(last)
+			delete(c.items, last.Value.(*regexpEntry).pattern)
+		}
+	}
+	return re, err
+}
@@ -3,12 +3,13 @@ package microlisp
 import "fmt"
 
 // Standart logic functions (first-order logic) with lazy evaluation
+// nil is false
 var StandartLogicFunctions = FunctionMap{
 	"not": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
 		if len(expr) != 1 {
 			return NewErrorStatement(fmt.Errorf("function `not' required one param"))
 		}
-		v := Eval(funcs, env, &expr[0])
+		v := nilAs(Eval(funcs, env, &expr[0]), NewBoolStatement(false))
 		if v.Type() == STError {
 			return v
 		}
@@ -22,7 +23,7 @@ var StandartLogicFunctions = FunctionMap{
 			return NewErrorStatement(fmt.Errorf("function `and' required at least one param"))
 		}
 		for _, e := range expr {
-			v := Eval(funcs, env, &e)
+			v := nilAs(Eval(funcs, env, &e), NewBoolStatement(false))
 			if v.Type() == STError {
 				return v
 			}
@@ -40,7 +41,7 @@ var StandartLogicFunctions = FunctionMap{
 			return NewErrorStatement(fmt.Errorf("function `or' required at least one param"))
 		}
 		for _, e := range expr {
-			v := Eval(funcs, env, &e)
+			v := nilAs(Eval(funcs, env, &e), NewBoolStatement(false))
 			if v.Type() == STError {
 				return v
 			}
@@ -57,7 +58,7 @@ var StandartLogicFunctions = FunctionMap{
 		if len(expr) != 3 {
 			return NewErrorStatement(fmt.Errorf("function `if' required 3 param"))
 		}
-		cond := Eval(funcs, env, &expr[0])
+		cond := nilAs(Eval(funcs, env, &expr[0]), NewBoolStatement(false))
 		if cond.Type() == STError {
 			return cond
 		}
@@ -70,4 +71,157 @@ var StandartLogicFunctions = FunctionMap{
 			return Eval(funcs, env, &expr[2])
 		}
 	},
+	// (cond (test body...)... (else body...)), body of the first true test is evaluated,
+	// nil if there is no such clause
+	"cond": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		for i, c := range expr {
+			clause := c.ValueExpression()
+			if c.Type() != STExpression || len(clause) < 2 {
+				return NewErrorStatement(fmt.Errorf("function `cond' expect (test body...) clause"))
+			}
+			if isElseClause(clause) {
+				if i != len(expr)-1 {
+					return NewErrorStatement(fmt.Errorf("function `cond' expect else clause to be the last"))
+				}
+				return EvalProgram(funcs, env, clause[1:])
+			}
+			test := clauseHead(clause[0])
+			ok, errStm := evalCondition("cond", funcs, env, &test)
+			if errStm != nil {
+				return *errStm
+			}
+			if ok {
+				return EvalProgram(funcs, env, clause[1:])
+			}
+		}
+		return NewNilStatement()
+	},
+	// (case key ((literal...) body...) (literal body...)... (else body...)),
+	// literals are not evaluated, they are compared with key by value like `='
+	"case": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		return selectClause("case", funcs, env, expr, false)
+	},
+	// (switch key (value body...)... (else body...)), like case, but values are evaluated in order
+	"switch": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		return selectClause("switch", funcs, env, expr, true)
+	},
+	// (when test body...), nil if test is false
+	"when": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		return whenUnless("when", funcs, env, expr, true)
+	},
+	// (unless test body...), nil if test is true
+	"unless": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		return whenUnless("unless", funcs, env, expr, false)
+	},
+	"nil?": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		if len(expr) != 1 {
+			return NewErrorStatement(fmt.Errorf("function `nil?' required one param"))
+		}
+		v := Eval(funcs, env, &expr[0])
+		if v.Type() == STError {
+			return v
+		}
+		return NewBoolStatement(v.Type() == STNil)
+	},
+	// first not nil value, params after it are not evaluated
+	"coalesce": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		if len(expr) == 0 {
+			return NewErrorStatement(fmt.Errorf("function `coalesce' required at least one param"))
+		}
+		for _, e := range expr {
+			v := Eval(funcs, env, &e)
+			if v.Type() != STNil {
+				return v
+			}
+		}
+		return NewNilStatement()
+	},
+}
+
+// Evaluate condition, nil is false
+func evalCondition(name string, funcs *FunctionMap, env *Environment, expr *Statement) (bool, *Statement) {
+	v := nilAs(Eval(funcs, env, expr), NewBoolStatement(false))
+	if v.Type() == STError {
+		return false, &v
+	}
+	if v.Type() != STBool {
+		err := NewErrorStatement(fmt.Errorf("function `%s' expect bool param in condition", name))
+		return false, &err
+	}
+	return v.ValueBool(), nil
+}
+
+func whenUnless(name string, funcs *FunctionMap, env *Environment, expr []Statement, when bool) Statement {
+	if len(expr) < 2 {
+		return NewErrorStatement(fmt.Errorf("function `%s' required test and body", name))
+	}
+	ok, errStm := evalCondition(name, funcs, env, &expr[0])
+	if errStm != nil {
+		return *errStm
+	}
+	if ok != when {
+		return NewNilStatement()
+	}
+	return EvalProgram(funcs, env, expr[1:])
+}
+
+// Body of the first clause matching key for `case' and `switch', nil if none matches
+func selectClause(name string, funcs *FunctionMap, env *Environment, expr []Statement, evaluated bool) Statement {
+	if len(expr) == 0 {
+		return NewErrorStatement(fmt.Errorf("function `%s' required at least one param", name))
+	}
+	key := Eval(funcs, env, &expr[0])
+	if key.Type() == STError {
+		return key
+	}
+	for i, c := range expr[1:] {
+		clause := c.ValueExpression()
+		if c.Type() != STExpression || len(clause) < 2 {
+			return NewErrorStatement(fmt.Errorf("function `%s' expect (value body...) clause", name))
+		}
+		if isElseClause(clause) {
+			if i != len(expr)-2 {
+				return NewErrorStatement(fmt.Errorf("function `%s' expect else clause to be the last", name))
+			}
+			return EvalProgram(funcs, env, clause[1:])
+		}
+		values := []Statement{clauseHead(clause[0])}
+		if !evaluated && clause[0].Type() == STExpression {
+			values = clause[0].ValueExpression()
+		}
+		for _, v := range values {
+			v = clauseHead(v)
+			if evaluated {
+				if v = Eval(funcs, env, &v); v.Type() == STError {
+					return v
+				}
+			}
+			if CompareStatements(key, v) == 0 {
+				return EvalProgram(funcs, env, clause[1:])
+			}
+		}
+	}
+	return NewNilStatement()
+}
+
+func isElseClause(clause []Statement) bool {
+	return clause[0].Type() == STString && !clause[0].Quoted() && clause[0].ValueString() == "else"
+}
+
+// First element of clause as it would be read in other places: parser does not convert it like function name
+func clauseHead(s Statement) Statement {
+	if s.Type() != STString || s.Quoted() {
+		return s
+	}
+	res := NewStatement(s.ValueString(), true)
+	res.Source = s.Source
+	return res
+}
+
+// Replace nil value by v
+func nilAs(s Statement, v Statement) Statement {
+	if s.Type() == STNil {
+		return v
+	}
+	return s
 }
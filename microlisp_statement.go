@@ -2,11 +2,18 @@ package microlisp
 
 import (
 	"fmt"
+	"slices"
 	"strconv"
+	"time"
 )
 
 // Create new statement from string token (common during parsing)
 func NewStatement(inp string, tryConvert bool) Statement {
+	return ParseOptions{}.NewStatement(inp, tryConvert)
+}
+
+// Create new statement from string token with parser settings
+func (opts ParseOptions) NewStatement(inp string, tryConvert bool) Statement {
 	if !tryConvert {
 		return Statement{Value: inp}
 	}
@@ -16,47 +23,167 @@ func NewStatement(inp string, tryConvert bool) Statement {
 	if inp == "false" {
 		return Statement{Value: false}
 	}
-	i, err := strconv.ParseInt(inp, 10, 32)
-	if err == nil {
-		return Statement{Value: int(i)}
+	if inp == "nil" {
+		return NewNilStatement()
 	}
-	f, err := strconv.ParseFloat(inp, 32)
+	i, err := strconv.ParseInt(inp, 10, 64)
 	if err == nil {
+		return Statement{Value: i}
+	}
+	if opts.Float64 {
+		if f, err := strconv.ParseFloat(inp, 64); err == nil {
+			return Statement{Value: f}
+		}
+	} else if f, err := strconv.ParseFloat(inp, 32); err == nil {
 		return Statement{Value: float32(f)}
 	}
+	if d, ok := parseDecimalLiteral(inp); ok {
+		return Statement{Value: d}
+	}
+	if t, ok := parseTimeLiteral(inp); ok {
+		return Statement{Value: t}
+	}
+	if d, ok := parseDurationLiteral(inp); ok {
+		return Statement{Value: d}
+	}
 	return Statement{Value: inp}
 }
 
 func NewExpressionStatement(inp []Statement) Statement {
-	return Statement{inp}
+	return Statement{Value: inp}
 }
 
 func NewStringStatement(inp string) Statement {
-	return Statement{inp}
+	return Statement{Value: inp}
+}
+
+// String literal from double quotes: kept as is, never treated as `env' reference
+func NewQuotedStringStatement(inp string) Statement {
+	return Statement{Value: inp, Source: &SourceInfo{Quoted: true}}
+}
+
+func (s Statement) Quoted() bool {
+	return s.Source != nil && s.Source.Quoted
+}
+
+// Where statement starts in source, zero if it is not parsed
+func (s Statement) Pos() Position {
+	if s.Source == nil {
+		return Position{}
+	}
+	return s.Source.Pos
+}
+
+func (s Statement) Comments() []Comment {
+	if s.Source == nil {
+		return nil
+	}
+	return s.Source.Comments
+}
+
+func (s Statement) Trailing() []Comment {
+	if s.Source == nil {
+		return nil
+	}
+	return s.Source.Trailing
+}
+
+// Source text of literal, empty if s is not parsed from literal
+func (s Statement) sourceText() string {
+	if s.Source == nil {
+		return ""
+	}
+	return s.Source.Text
+}
+
+// Change source details of s, other copies of s keep the old ones
+func (s *Statement) editSource(edit func(info *SourceInfo)) {
+	var info SourceInfo
+	if s.Source != nil {
+		info = *s.Source
+	}
+	edit(&info)
+	s.Source = &info
+}
+
+func (s *Statement) setPos(pos Position) {
+	s.editSource(func(info *SourceInfo) { info.Pos = pos })
+}
+
+func (s *Statement) addComments(comments []Comment) {
+	if len(comments) > 0 {
+		s.editSource(func(info *SourceInfo) { info.Comments = slices.Concat(comments, info.Comments) })
+	}
+}
+
+func (s *Statement) addTrailing(comments []Comment) {
+	if len(comments) > 0 {
+		s.editSource(func(info *SourceInfo) { info.Trailing = slices.Concat(info.Trailing, comments) })
+	}
 }
 
 func NewErrorStatement(inp error) Statement {
-	return Statement{inp}
+	return Statement{Value: inp}
 }
 
-func NewIntStatement(inp int) Statement {
-	return Statement{inp}
+func NewIntStatement(inp int64) Statement {
+	return Statement{Value: inp}
 }
 
 func NewFloatStatement(inp float32) Statement {
-	return Statement{inp}
+	return Statement{Value: inp}
+}
+
+func NewFloat64Statement(inp float64) Statement {
+	return Statement{Value: inp}
+}
+
+// Float statement of float64 precision if wide is set, of float32 otherwise
+func newFloatResult(inp float64, wide bool) Statement {
+	if wide {
+		return NewFloat64Statement(inp)
+	}
+	return NewFloatStatement(float32(inp))
 }
 
 func NewFloatArrayStatement(inp []float32) Statement {
-	return Statement{inp}
+	return Statement{Value: inp}
 }
 
 func NewBoolStatement(inp bool) Statement {
-	return Statement{inp}
+	return Statement{Value: inp}
 }
 
 func NewFuzzyStatement(inp FuzzySetType) Statement {
-	return Statement{inp}
+	return Statement{Value: inp}
+}
+
+func NewListStatement(inp []Statement) Statement {
+	return Statement{Value: ListType(inp)}
+}
+
+func NewMapStatement(inp map[string]Statement) Statement {
+	return Statement{Value: MapType(inp)}
+}
+
+func NewNilStatement() Statement {
+	return Statement{Value: NilType{}}
+}
+
+func NewTimeStatement(inp time.Time) Statement {
+	return Statement{Value: inp}
+}
+
+func NewDurationStatement(inp time.Duration) Statement {
+	return Statement{Value: inp}
+}
+
+func NewDecimalStatement(inp Decimal) Statement {
+	return Statement{Value: inp}
+}
+
+func NewFunctionStatement(inp *Lambda) Statement {
+	return Statement{Value: inp}
 }
 
 //return
@@ -66,9 +193,9 @@ func (s Statement) Type() StatementType {
 		return STExpression
 	case string:
 		return STString
-	case int:
+	case int64:
 		return STInt
-	case float32:
+	case float32, float64:
 		return STFloat
 	case []float32:
 		return STFloatArray
@@ -76,6 +203,20 @@ func (s Statement) Type() StatementType {
 		return STBool
 	case FuzzySetType:
 		return STFuzzy
+	case ListType:
+		return STList
+	case MapType:
+		return STMap
+	case NilType:
+		return STNil
+	case time.Time:
+		return STTime
+	case time.Duration:
+		return STDuration
+	case Decimal:
+		return STDecimal
+	case *Lambda:
+		return STFunction
 	case error:
 		return STError
 	default:
@@ -90,6 +231,52 @@ func (s Statement) ValueExpression() []Statement {
 	return make([]Statement, 0)
 }
 
+func (s Statement) ValueList() []Statement {
+	if s.Type() == STList {
+		return s.Value.(ListType)
+	}
+	return make([]Statement, 0)
+}
+
+func (s Statement) ValueMap() map[string]Statement {
+	if s.Type() == STMap {
+		return s.Value.(MapType)
+	}
+	return make(map[string]Statement)
+}
+
+func (s Statement) ValueTime() time.Time {
+	if s.Type() == STTime {
+		return s.Value.(time.Time)
+	}
+	return time.Time{}
+}
+
+func (s Statement) ValueDuration() time.Duration {
+	if s.Type() == STDuration {
+		return s.Value.(time.Duration)
+	}
+	return 0
+}
+
+// int values are converted
+func (s Statement) ValueDecimal() Decimal {
+	switch v := s.Value.(type) {
+	case Decimal:
+		return v
+	case int64:
+		return NewDecimal(v, 0)
+	}
+	return NewDecimal(0, 0)
+}
+
+func (s Statement) ValueFunction() *Lambda {
+	if s.Type() == STFunction {
+		return s.Value.(*Lambda)
+	}
+	return &Lambda{}
+}
+
 func (s Statement) ValueString() string {
 	if s.Type() == STString {
 		return s.Value.(string)
@@ -104,31 +291,40 @@ func (s Statement) ValueError() error {
 	return fmt.Errorf("")
 }
 
-func (s Statement) ValueInt() int {
+func (s Statement) ValueInt() int64 {
 	if s.Type() == STInt {
-		return s.Value.(int)
+		return s.Value.(int64)
 	}
 	return 0
 }
 
-func (s Statement) ValueFloat() float32 {
-	if s.Type() == STFloat {
-		return s.Value.(float32)
-	}
-	if s.Type() == STInt {
-		return float32(s.Value.(int))
+// float32 values are widened, int and decimal values are converted
+func (s Statement) ValueFloat() float64 {
+	switch v := s.Value.(type) {
+	case Decimal:
+		return v.Float64()
+	case float32:
+		return float64(v)
+	case float64:
+		return v
+	case int64:
+		return float64(v)
 	}
 	return 0.0
 }
 
+// Is it float of float64 precision
+func (s Statement) IsFloat64() bool {
+	_, ok := s.Value.(float64)
+	return ok
+}
+
 func (s Statement) ValueFloatArray() []float32 {
 	switch s.Type() {
 	case STFloatArray:
 		return s.Value.([]float32)
-	case STFloat:
-		return []float32{s.Value.(float32)}
-	case STInt:
-		return []float32{float32(s.Value.(int))}
+	case STFloat, STInt:
+		return []float32{float32(s.ValueFloat())}
 	default:
 		return make([]float32, 0)
 	}
@@ -142,7 +338,6 @@ func (s Statement) ValueBool() bool {
 }
 
 // Check statement equality
-// TODO: add check FuzzySet values
 func IsEqualStatements(s1 Statement, s2 Statement) bool {
 	if s1.Type() != s2.Type() {
 		return false
@@ -154,14 +349,35 @@ func IsEqualStatements(s1 Statement, s2 Statement) bool {
 		return s1.ValueInt() == s2.ValueInt()
 	}
 	if s1.Type() == STFloat {
+		if !s1.IsFloat64() || !s2.IsFloat64() { // compare in the lower precision
+			return float32(s1.ValueFloat()) == float32(s2.ValueFloat())
+		}
 		return s1.ValueFloat() == s2.ValueFloat()
 	}
 	if s1.Type() == STBool {
 		return s1.ValueBool() == s2.ValueBool()
 	}
-	if s1.Type() == STExpression {
+	if s1.Type() == STNil {
+		return true
+	}
+	if s1.Type() == STTime {
+		return s1.ValueTime().Equal(s2.ValueTime())
+	}
+	if s1.Type() == STDuration {
+		return s1.ValueDuration() == s2.ValueDuration()
+	}
+	if s1.Type() == STDecimal {
+		return s1.ValueDecimal().Cmp(s2.ValueDecimal()) == 0
+	}
+	if s1.Type() == STFunction { // the same function value
+		return s1.ValueFunction() == s2.ValueFunction()
+	}
+	if s1.Type() == STExpression || s1.Type() == STList {
 		exp1 := s1.ValueExpression()
 		exp2 := s2.ValueExpression()
+		if s1.Type() == STList {
+			exp1, exp2 = s1.ValueList(), s2.ValueList()
+		}
 		if len(exp1) != len(exp2) {
 			return false
 		}
@@ -175,5 +391,44 @@ func IsEqualStatements(s1 Statement, s2 Statement) bool {
 	if s1.Type() == STError {
 		return s1.ValueError().Error() == s2.ValueError().Error()
 	}
+	if s1.Type() == STFloatArray {
+		arr1 := s1.ValueFloatArray()
+		arr2 := s2.ValueFloatArray()
+		if len(arr1) != len(arr2) {
+			return false
+		}
+		for i := range arr1 {
+			if arr1[i] != arr2[i] {
+				return false
+			}
+		}
+		return true
+	}
+	if s1.Type() == STMap {
+		map1 := s1.ValueMap()
+		map2 := s2.ValueMap()
+		if len(map1) != len(map2) {
+			return false
+		}
+		for k, v1 := range map1 {
+			if v2, ok := map2[k]; !ok || !IsEqualStatements(v1, v2) {
+				return false
+			}
+		}
+		return true
+	}
+	if s1.Type() == STFuzzy {
+		set1 := s1.Value.(FuzzySetType)
+		set2 := s2.Value.(FuzzySetType)
+		if len(set1) != len(set2) {
+			return false
+		}
+		for i := range set1 {
+			if set1[i].Percent != set2[i].Percent || !IsEqualStatements(set1[i].Value, set2[i].Value) {
+				return false
+			}
+		}
+		return true
+	}
 	return false
 }
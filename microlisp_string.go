@@ -0,0 +1,300 @@
+package microlisp
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// String functions, all params are evaluated.
+// lengths and indexes are counted in runes
+var StringFunctions = FunctionMap{
+	"concat": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		if len(expr) == 0 {
+			return NewErrorStatement(fmt.Errorf("function `concat' required at least one param"))
+		}
+		var b strings.Builder
+		for i := range expr {
+			v := Eval(funcs, env, &expr[i])
+			if v.Type() == STError {
+				return v
+			}
+			if v.Type() != STString {
+				return NewErrorStatement(fmt.Errorf("function `concat' expect string param"))
+			}
+			b.WriteString(v.ValueString())
+		}
+		return NewStringStatement(b.String())
+	},
+	"length": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("length", funcs, env, expr, 1, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		return NewIntStatement(int64(utf8.RuneCountInString(args[0].ValueString())))
+	},
+	// (substring s start) or (substring s start end), end is exclusive
+	"substring": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("substring", funcs, env, expr, 2, STString, STInt, STInt)
+		if errStm != nil {
+			return *errStm
+		}
+		s := []rune(args[0].ValueString())
+		start, end := args[1].ValueInt(), int64(len(s))
+		if len(args) == 3 {
+			end = args[2].ValueInt()
+		}
+		if start < 0 || end < start || end > int64(len(s)) {
+			return NewErrorStatement(fmt.Errorf("function `substring' range [%d:%d] out of length %d", start, end, len(s)))
+		}
+		return NewStringStatement(string(s[start:end]))
+	},
+	"upper": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("upper", funcs, env, expr, 1, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		return NewStringStatement(strings.ToUpper(args[0].ValueString()))
+	},
+	"lower": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("lower", funcs, env, expr, 1, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		return NewStringStatement(strings.ToLower(args[0].ValueString()))
+	},
+	// (trim s) removes white space, (trim s cutset) removes runes of cutset
+	"trim": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("trim", funcs, env, expr, 1, STString, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		if len(args) == 2 {
+			return NewStringStatement(strings.Trim(args[0].ValueString(), args[1].ValueString()))
+		}
+		return NewStringStatement(strings.TrimSpace(args[0].ValueString()))
+	},
+	"starts-with?": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("starts-with?", funcs, env, expr, 2, STString, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		return NewBoolStatement(strings.HasPrefix(args[0].ValueString(), args[1].ValueString()))
+	},
+	"ends-with?": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("ends-with?", funcs, env, expr, 2, STString, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		return NewBoolStatement(strings.HasSuffix(args[0].ValueString(), args[1].ValueString()))
+	},
+	"contains?": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("contains?", funcs, env, expr, 2, STString, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		return NewBoolStatement(strings.Contains(args[0].ValueString(), args[1].ValueString()))
+	},
+	// (split s sep) gives list of strings, empty sep splits into runes
+	"split": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("split", funcs, env, expr, 2, STString, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		parts := strings.Split(args[0].ValueString(), args[1].ValueString())
+		res := make([]Statement, len(parts))
+		for i, p := range parts {
+			res[i] = NewStringStatement(p)
+		}
+		return NewListStatement(res)
+	},
+	// (join parts sep), parts is list of strings
+	"join": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("join", funcs, env, expr, 2, STList, STString)
+		if errStm != nil {
+			return *errStm
+		}
+		parts := args[0].ValueList()
+		strs := make([]string, len(parts))
+		for i, p := range parts {
+			if p.Type() != STString {
+				return NewErrorStatement(fmt.Errorf("function `join' expect strings to join"))
+			}
+			strs[i] = p.ValueString()
+		}
+		return NewStringStatement(strings.Join(strs, args[1].ValueString()))
+	},
+	// (replace s old new) replaces all, (replace s old new n) the first n
+	"replace": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		args, errStm := stringParams("replace", funcs, env, expr, 3, STString, STString, STString, STInt)
+		if errStm != nil {
+			return *errStm
+		}
+		n := int64(-1)
+		if len(args) == 4 {
+			n = args[3].ValueInt()
+		}
+		return NewStringStatement(strings.Replace(args[0].ValueString(), args[1].ValueString(), args[2].ValueString(), int(n)))
+	},
+	// (pad-left s width) or (pad-left s width pad), pad is one rune, space by default
+	"pad-left": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		return padString("pad-left", funcs, env, expr, true)
+	},
+	"pad-right": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		return padString("pad-right", funcs, env, expr, false)
+	},
+	// (format pattern args...) like fmt.Sprintf, verbs are checked against param types:
+	// %s %q for strings, %d %c %o %b for ints, %x %X for ints and strings,
+	// %f %e %g %E %G for numbers, %t for bools, %v for any value
+	"format": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+		if len(expr) == 0 {
+			return NewErrorStatement(fmt.Errorf("function `format' required at least one param"))
+		}
+		args := make([]Statement, len(expr))
+		for i := range expr {
+			args[i] = Eval(funcs, env, &expr[i])
+			if args[i].Type() == STError {
+				return args[i]
+			}
+		}
+		if args[0].Type() != STString {
+			return NewErrorStatement(fmt.Errorf("function `format' expect string pattern"))
+		}
+		res, err := formatString(args[0].ValueString(), args[1:])
+		if err != nil {
+			return NewErrorStatement(fmt.Errorf("function `format' %w", err))
+		}
+		return NewStringStatement(res)
+	},
+}
+
+// Evaluate params and check their types, params after required are optional
+func stringParams(name string, funcs *FunctionMap, env *Environment, expr []Statement,
+	required int, types ...StatementType) ([]Statement, *Statement) {
+	if len(expr) < required || len(expr) > len(types) {
+		var err Statement
+		switch {
+		case required == len(types) && required == 1:
+			err = NewErrorStatement(fmt.Errorf("function `%s' required one param", name))
+		case required == len(types):
+			err = NewErrorStatement(fmt.Errorf("function `%s' required %d param", name, required))
+		default:
+			err = NewErrorStatement(fmt.Errorf("function `%s' required %d to %d param", name, required, len(types)))
+		}
+		return nil, &err
+	}
+	args := make([]Statement, len(expr))
+	for i := range expr {
+		args[i] = Eval(funcs, env, &expr[i])
+		if args[i].Type() == STError {
+			return nil, &args[i]
+		}
+		if args[i].Type() != types[i] {
+			err := NewErrorStatement(fmt.Errorf("function `%s' expect %s param", name, paramKinds[types[i]]))
+			return nil, &err
+		}
+	}
+	return args, nil
+}
+
+var paramKinds = map[StatementType]string{
+	STExpression: "expression",
+	STList:       "list",
+	STMap:        "map",
+	STNil:        "nil",
+	STTime:       "time",
+	STDuration:   "duration",
+	STDecimal:    "decimal",
+	STFunction:   "function",
+	STString:     "string",
+	STInt:        "int",
+	STFloat:      "float",
+	STBool:       "bool",
+}
+
+func padString(name string, funcs *FunctionMap, env *Environment, expr []Statement, left bool) Statement {
+	args, errStm := stringParams(name, funcs, env, expr, 2, STString, STInt, STString)
+	if errStm != nil {
+		return *errStm
+	}
+	pad := " "
+	if len(args) == 3 {
+		pad = args[2].ValueString()
+		if utf8.RuneCountInString(pad) != 1 {
+			return NewErrorStatement(fmt.Errorf("function `%s' expect one rune to pad", name))
+		}
+	}
+	s := args[0].ValueString()
+	n := args[1].ValueInt() - int64(utf8.RuneCountInString(s))
+	if n <= 0 {
+		return NewStringStatement(s)
+	}
+	if n > maxPadding {
+		return NewErrorStatement(fmt.Errorf("function `%s' width is too large", name))
+	}
+	if left {
+		return NewStringStatement(strings.Repeat(pad, int(n)) + s)
+	}
+	return NewStringStatement(s + strings.Repeat(pad, int(n)))
+}
+
+const maxPadding = 1 << 16
+
+// Sprintf with verbs checked against statement types
+func formatString(pattern string, args []Statement) (string, error) {
+	values := make([]interface{}, 0, len(args))
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			continue
+		}
+		i++
+		for n := 0; i < len(pattern) && strings.IndexByte("+-# 0123456789.", pattern[i]) >= 0; i++ {
+			if pattern[i] < '0' || pattern[i] > '9' {
+				n = 0
+				continue
+			}
+			if n = n*10 + int(pattern[i]-'0'); n > maxPadding { // width and precision are limited like padding
+				return "", fmt.Errorf("width or precision is too large")
+			}
+		}
+		if i == len(pattern) {
+			return "", fmt.Errorf("incomplete verb at end of pattern")
+		}
+		verb := pattern[i]
+		if verb == '%' {
+			continue
+		}
+		if len(values) == len(args) {
+			return "", fmt.Errorf("missing param for %%%c", verb)
+		}
+		arg := args[len(values)]
+		var v interface{}
+		switch {
+		case verb == 'v':
+			switch arg.Type() {
+			case STString, STInt, STFloat, STBool:
+				v = arg.Value
+			case STDecimal:
+				v = arg.ValueDecimal().String()
+			default:
+				v = Format(arg)
+			}
+		case strings.IndexByte("sq", verb) >= 0 && arg.Type() == STString,
+			strings.IndexByte("dcob", verb) >= 0 && arg.Type() == STInt,
+			strings.IndexByte("xX", verb) >= 0 && (arg.Type() == STInt || arg.Type() == STString),
+			verb == 't' && arg.Type() == STBool:
+			v = arg.Value
+		case strings.IndexByte("feEgG", verb) >= 0 && (arg.Type() == STInt || arg.Type() == STFloat):
+			v = arg.ValueFloat()
+		case strings.IndexByte("sqdcobxXfeEgGt", verb) >= 0:
+			return "", fmt.Errorf("verb %%%c does not accept %s param", verb, Format(arg))
+		default:
+			return "", fmt.Errorf("unsupported verb %%%c", verb)
+		}
+		values = append(values, v)
+	}
+	if len(values) != len(args) {
+		return "", fmt.Errorf("too many params for pattern")
+	}
+	return fmt.Sprintf(pattern, values...), nil
+}
@@ -1,10 +1,18 @@
 package microlisp
 
 import (
+	"cmp"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+	"unsafe"
 )
 
 func TestStatementType(t *testing.T) {
@@ -13,6 +21,8 @@ func TestStatementType(t *testing.T) {
 		outp StatementType
 	}{
 		{NewStringStatement("a"), STString},
+		{NewListStatement([]Statement{NewStringStatement("a")}), STList},
+		{NewExpressionStatement([]Statement{NewStringStatement("a")}), STExpression},
 	}
 	for _, test := range tests {
 		x := test.inp.Type()
@@ -28,14 +38,38 @@ func TestTokens1(t *testing.T) {
 		inp  string
 		outp Tokens
 	}{
-		{" ( somef ) ", Tokens{{openToken, "("}, {atomToken, "somef"}, {closeToken, ")"}}},
-		{"somef", Tokens{{atomToken, "somef"}}},
-		{")((somef))", Tokens{{closeToken, ")"}, {openToken, "("},
-			{openToken, "("}, {atomToken, "somef"}, {closeToken, ")"},
-			{closeToken, ")"}}},
+		{" ( somef ) ", Tokens{{typ: openToken, val: "("}, {typ: atomToken, val: "somef"}, {typ: closeToken, val: ")"}}},
+		{"somef", Tokens{{typ: atomToken, val: "somef"}}},
+		{")((somef))", Tokens{{typ: closeToken, val: ")"}, {typ: openToken, val: "("},
+			{typ: openToken, val: "("}, {typ: atomToken, val: "somef"}, {typ: closeToken, val: ")"},
+			{typ: closeToken, val: ")"}}},
+		{`(f "New York" "(pending)")`, Tokens{{typ: openToken, val: "("}, {typ: atomToken, val: "f"},
+			{typ: stringToken, val: "New York"}, {typ: stringToken, val: "(pending)"}, {typ: closeToken, val: ")"}}},
+		{`"a\"b\\c\nd\u00e9\ud83d\ude00"`, Tokens{{typ: stringToken, val: "a\"b\\c\nd\u00e9\U0001F600"}}},
+		{`x"y"`, Tokens{{typ: atomToken, val: "x"}, {typ: stringToken, val: "y"}}},
+		{`""`, Tokens{{typ: stringToken, val: ""}}},
+		{"(f ; why\n a)", Tokens{{typ: openToken, val: "("}, {typ: atomToken, val: "f"}, {typ: commentToken, val: "; why"},
+			{typ: atomToken, val: "a"}, {typ: closeToken, val: ")"}}},
+		{"a #|x #|y|# z|#b", Tokens{{typ: atomToken, val: "a"}, {typ: commentToken, val: "#|x #|y|# z|#"}, {typ: atomToken, val: "b"}}},
+		{`"a;b"`, Tokens{{typ: stringToken, val: "a;b"}}},
+		{"\xffé\xfe(", Tokens{{typ: atomToken, val: "\xffé\xfe"}, {typ: openToken, val: "("}}},
+		{"#a #", Tokens{{typ: atomToken, val: "#a"}, {typ: atomToken, val: "#"}}},
+		{`!a[0]["x] y"].b [1]`, Tokens{{typ: atomToken, val: `!a[0]["x] y"].b`}, {typ: openBracketToken, val: "["},
+			{typ: atomToken, val: "1"}, {typ: closeBracketToken, val: "]"}}},
+		{"(f a[1 2])", Tokens{{typ: openToken, val: "("}, {typ: atomToken, val: "f"}, {typ: atomToken, val: "a"},
+			{typ: openBracketToken, val: "["}, {typ: atomToken, val: "1"}, {typ: atomToken, val: "2"},
+			{typ: closeBracketToken, val: "]"}, {typ: closeToken, val: ")"}}},
+		{`a["b` + "\n" + `"]`, Tokens{{typ: atomToken, val: "a"}, {typ: openBracketToken, val: "["},
+			{typ: stringToken, val: "b\n"}, {typ: closeBracketToken, val: "]"}}},
 	}
 	for _, test := range tests {
-		x := splitToTokens(test.inp)
+		x, err := splitToTokens(test.inp)
+		if err != nil {
+			t.Errorf("SplitToTokens \"%v\" error \"%v\"", test.inp, err)
+		}
+		for _, tok := range x {
+			tok.pos, tok.end = Position{}, Position{}
+		}
 		if !reflect.DeepEqual(x, test.outp) {
 			t.Errorf("SplitToTokens \"%v\" gives \"%v\", expected \"%v\"",
 				test.inp, x, test.outp)
@@ -43,6 +77,27 @@ func TestTokens1(t *testing.T) {
 	}
 }
 
+func TestTokensErrors(t *testing.T) {
+	var tests = []struct {
+		inp string
+		err error
+	}{
+		{`(f "abc)`, ErrorUnterminatedString},
+		{`"abc\"`, ErrorUnterminatedString},
+		{`"a\qb"`, ErrorInvalidEscape},
+		{`"\u12"`, ErrorInvalidEscape},
+		{"(f #| a #| b |# )", ErrorUnterminatedComment},
+		{`'0["`, ErrorUnterminatedString},
+	}
+	for _, test := range tests {
+		_, err := splitToTokens(test.inp)
+		if !errors.Is(err, test.err) {
+			t.Errorf("SplitToTokens \"%v\" error is \"%v\", expected \"%v\"",
+				test.inp, err, test.err)
+		}
+	}
+}
+
 func TestAST(t *testing.T) {
 	var tests = []struct {
 		inp  string
@@ -85,6 +140,60 @@ func TestAST(t *testing.T) {
 			nil,
 			NewStringStatement("somef"),
 		},
+		{`(eq !city "New York" "true" "42" "!city")`,
+			nil,
+			NewExpressionStatement([]Statement{
+				NewStringStatement("eq"),
+				NewStringStatement("!city"),
+				NewQuotedStringStatement("New York"),
+				NewQuotedStringStatement("true"),
+				NewQuotedStringStatement("42"),
+				NewQuotedStringStatement("!city"),
+			}),
+		},
+		{`"(pending)"`,
+			nil,
+			NewQuotedStringStatement("(pending)"),
+		},
+		{"(f [0.1 2 -3e2] [] {low:0.2 mid: 0.5 \"New York\":0.3 \"a b\": 1 12:30:0 1:1})",
+			nil,
+			NewExpressionStatement([]Statement{
+				NewStringStatement("f"),
+				NewFloatArrayStatement([]float32{0.1, 2, -300}),
+				NewFloatArrayStatement([]float32{}),
+				NewFuzzyStatement(FuzzySetType{
+					{NewStringStatement("low"), 0.2},
+					{NewStringStatement("mid"), 0.5},
+					{NewQuotedStringStatement("New York"), 0.3},
+					{NewQuotedStringStatement("a b"), 1},
+					{NewStringStatement("12:30"), 0},
+					{NewIntStatement(1), 1},
+				}),
+			}),
+		},
+		{"[1 ; one\n 2]",
+			nil,
+			func() Statement {
+				s := NewFloatArrayStatement([]float32{1, 2})
+				s.addTrailing([]Comment{{Text: "; one", Inline: true}})
+				return s
+			}(),
+		},
+		{"{}",
+			nil,
+			NewFuzzyStatement(FuzzySetType{}),
+		},
+		{"(f [1 a])", ErrorInvalidLiteral, Statement{}},
+		{"(f [1 (g)])", ErrorInvalidLiteral, Statement{}},
+		{"{a:x}", ErrorInvalidLiteral, Statement{}},
+		{"{a 0.5}", ErrorInvalidLiteral, Statement{}},
+		{"{\"a\" 0.5}", ErrorInvalidLiteral, Statement{}},
+		{"{:0.5}", ErrorInvalidLiteral, Statement{}},
+		{"{a:}", ErrorInvalidLiteral, Statement{}},
+		{"{a: 0.5", ErrorEndOfExpression, Statement{}},
+		{"(f [1 2)", ErrorInvalidLiteral, Statement{}},
+		{"(f 1])", ErrorUnexpectedClose, Statement{}},
+		{"}", ErrorExpectOpen, Statement{}},
 		{"somef erratom",
 			ErrorExpectOpen,
 			Statement{},
@@ -112,11 +221,11 @@ func TestAST(t *testing.T) {
 	}
 	for _, test := range tests {
 		ast, err := Parse(test.inp)
-		if err != test.err {
+		if !errors.Is(err, test.err) {
 			t.Errorf("BuildAST \"%v\" error is \"%v\", expected \"%v\"",
 				test.inp, err, test.err)
 		}
-		if !reflect.DeepEqual(ast, test.outp) {
+		if !reflect.DeepEqual(clearPos(ast), test.outp) {
 			t.Errorf("BuildAST \"%v\" gives \"%#v\", expected \"%#v\"",
 				test.inp, ast, test.outp)
 		}
@@ -124,6 +233,563 @@ func TestAST(t *testing.T) {
 
 }
 
+// Drop source positions to compare with constructed statements
+func clearPos(s Statement) Statement {
+	if s.Source != nil {
+		s.editSource(func(info *SourceInfo) { info.Pos, info.Text = Position{}, "" })
+		if reflect.DeepEqual(*s.Source, SourceInfo{}) {
+			s.Source = nil
+		}
+	}
+	if s.Type() == STExpression {
+		e := make([]Statement, len(s.ValueExpression()))
+		for i, x := range s.ValueExpression() {
+			e[i] = clearPos(x)
+		}
+		s.Value = e
+	}
+	if s.Type() == STFuzzy {
+		set := make(FuzzySetType, len(s.Value.(FuzzySetType)))
+		for i, x := range s.Value.(FuzzySetType) {
+			set[i] = FuzzyElement{clearPos(x.Value), x.Percent}
+		}
+		s.Value = set
+	}
+	return s
+}
+
+func TestPositions(t *testing.T) {
+	ast, err := Parse("(and\n  !a\n\t(not \"é\" b))")
+	if err != nil {
+		t.Fatalf("Parse error \"%v\"", err)
+	}
+	e := ast.ValueExpression()
+	inner := e[2].ValueExpression()
+	var tests = []struct {
+		got  Position
+		outp Position
+	}{
+		{ast.Pos(), Position{0, 1, 1}},
+		{e[0].Pos(), Position{1, 1, 2}},
+		{e[1].Pos(), Position{7, 2, 3}},
+		{e[2].Pos(), Position{11, 3, 2}},
+		{inner[1].Pos(), Position{16, 3, 7}},
+		{inner[2].Pos(), Position{21, 3, 11}},
+	}
+	for i, test := range tests {
+		if test.got != test.outp {
+			t.Errorf("Position #%d is \"%#v\", expected \"%#v\"", i, test.got, test.outp)
+		}
+	}
+	// source details are kept apart, values stay small and comparable
+	if size := unsafe.Sizeof(Statement{}); size > 24 || NewIntStatement(1) != NewIntStatement(1) {
+		t.Errorf("Statement has size %d or is not comparable", size)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	var tests = []struct {
+		inp     string
+		err     error
+		pos     Position
+		message string
+	}{
+		{"(and !a\n  (or !b !c)",
+			ErrorEndOfExpression,
+			Position{20, 2, 13},
+			"2:13: unexprected end of expression\n  (or !b !c)\n            ^",
+		},
+		{"(and !a)\n\t !b",
+			ErrorTooManyTokens,
+			Position{11, 2, 3},
+			"2:3: too many tokens\n\t !b\n\t ^",
+		},
+		{"somef erratom",
+			ErrorExpectOpen,
+			Position{0, 1, 1},
+			"1:1: expected opening parenthesis\nsomef erratom\n^",
+		},
+		{"(f \"a\\qb\")",
+			ErrorInvalidEscape,
+			Position{3, 1, 4},
+			"1:4: invalid escape sequence in string literal\n(f \"a\\qb\")\n   ^",
+		},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.inp)
+		var perr *ParseError
+		if !errors.As(err, &perr) || !errors.Is(err, test.err) {
+			t.Errorf("Parse \"%v\" error is \"%#v\", expected \"%v\"", test.inp, err, test.err)
+			continue
+		}
+		if perr.Pos != test.pos || perr.Error() != test.message {
+			t.Errorf("Parse \"%v\" error \"%v\" at %#v, expected \"%v\" at %#v",
+				test.inp, perr, perr.Pos, test.message, test.pos)
+		}
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	ast, _ := Parse("(and !a\n  (not !b))")
+	env := Environment{"a": NewBoolStatement(true)}
+	val := Eval(&StandartLogicFunctions, &env, &ast)
+	if val.Type() != STError || val.Pos() != (Position{15, 2, 8}) {
+		t.Errorf("Eval error \"%#v\" at %#v, expected position 2:8", val, val.Pos())
+	}
+}
+
+func TestASTComments(t *testing.T) {
+	ast, err := Parse(`; rule header
+(and ; first clause
+  !a #| second
+  clause |# !b
+  ; dangling
+)
+; footer`)
+	if err != nil {
+		t.Fatalf("Parse with comments error \"%v\"", err)
+	}
+	e := ast.ValueExpression()
+	var tests = []struct {
+		got  []Comment
+		outp []Comment
+	}{
+		{ast.Comments(), []Comment{{Text: "; rule header"}}},
+		{ast.Trailing(), []Comment{{Text: "; footer"}}},
+		{e[0].Comments(), nil},
+		{e[0].Trailing(), []Comment{{Text: "; first clause", Inline: true}}},
+		{e[1].Comments(), nil},
+		{e[1].Trailing(), []Comment{{Text: "#| second\n  clause |#", Inline: true}}},
+		{e[2].Comments(), nil},
+		{e[2].Trailing(), []Comment{{Text: "; dangling"}}},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.got, test.outp) {
+			t.Errorf("Comments #%d gives \"%#v\", expected \"%#v\"", i, test.got, test.outp)
+		}
+	}
+	if len(e) != 3 || !IsEqualStatements(e[1], NewStringStatement("!a")) {
+		t.Errorf("Parse with comments gives \"%#v\"", ast)
+	}
+	for _, prog := range []string{"somef ; comment", "#| only |# somef"} {
+		if ast, err := Parse(prog); err != nil || !IsEqualStatements(ast, NewStringStatement("somef")) {
+			t.Errorf("Parse \"%v\" gives \"%#v\", error \"%v\"", prog, ast, err)
+		}
+	}
+	if _, err := Parse("; nothing but comment"); !errors.Is(err, ErrorEndOfExpression) {
+		t.Errorf("Parse comment only error is \"%v\", expected \"%v\"", err, ErrorEndOfExpression)
+	}
+}
+
+func TestParseProgram(t *testing.T) {
+	var tests = []struct {
+		inp  string
+		err  error
+		outp []Statement
+	}{
+		{"(f a) ; first\n!b \"c\" (g (h 1))",
+			nil,
+			[]Statement{
+				NewExpressionStatement([]Statement{NewStringStatement("f"), NewStringStatement("a")}),
+				NewStringStatement("!b"),
+				NewQuotedStringStatement("c"),
+				NewExpressionStatement([]Statement{NewStringStatement("g"),
+					NewExpressionStatement([]Statement{NewStringStatement("h"), NewIntStatement(1)})}),
+			},
+		},
+		{" ; nothing\n", nil, []Statement{}},
+		{"'a `(f ,x ,@y) '",
+			ErrorEndOfExpression, nil},
+		{"'a `(f ,x ,@y)",
+			nil,
+			[]Statement{
+				NewExpressionStatement([]Statement{NewStringStatement("quote"), NewStringStatement("a")}),
+				NewExpressionStatement([]Statement{NewStringStatement("quasiquote"),
+					NewExpressionStatement([]Statement{NewStringStatement("f"),
+						NewExpressionStatement([]Statement{NewStringStatement("unquote"), NewStringStatement("x")}),
+						NewExpressionStatement([]Statement{NewStringStatement("unquote-splicing"), NewStringStatement("y")}),
+					})}),
+			},
+		},
+		{"(f a) (g", ErrorEndOfExpression, nil},
+		{"(f a))", ErrorExpectOpen, nil},
+	}
+	for _, test := range tests {
+		forms, err := ParseProgram(test.inp)
+		if !errors.Is(err, test.err) {
+			t.Errorf("ParseProgram \"%v\" error is \"%v\", expected \"%v\"", test.inp, err, test.err)
+		}
+		if len(forms) != len(test.outp) {
+			t.Errorf("ParseProgram \"%v\" gives %d forms, expected %d", test.inp, len(forms), len(test.outp))
+			continue
+		}
+		for i := range forms {
+			if !IsEqualStatements(forms[i], test.outp[i]) {
+				t.Errorf("ParseProgram \"%v\" form %d is \"%#v\", expected \"%#v\"",
+					test.inp, i, forms[i], test.outp[i])
+			}
+		}
+	}
+}
+
+func TestEvalProgram(t *testing.T) {
+	var tests = []struct {
+		program string
+		result  Statement
+		all     []Statement
+	}{
+		{"(not !a) ; flag\n(and !a !b)",
+			NewBoolStatement(true),
+			[]Statement{NewBoolStatement(false), NewBoolStatement(true)},
+		},
+		{"!nokey (and !a !b)",
+			NewErrorStatement(fmt.Errorf("environment key `nokey' not found")),
+			[]Statement{NewErrorStatement(fmt.Errorf("environment key `nokey' not found")), NewBoolStatement(true)},
+		},
+		{"",
+			NewErrorStatement(fmt.Errorf("empty program")),
+			[]Statement{},
+		},
+	}
+	env := Environment{"a": NewBoolStatement(true), "b": NewBoolStatement(true)}
+	for _, test := range tests {
+		forms, err := ParseProgram(test.program)
+		if err != nil {
+			t.Errorf("ParseProgram \"%v\" error \"%v\"", test.program, err)
+		}
+		val := EvalProgram(&StandartLogicFunctions, &env, forms)
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("EvalProgram \"%v\" gives \"%#v\", expected \"%#v\"", test.program, val, test.result)
+		}
+		all := EvalProgramAll(&StandartLogicFunctions, &env, forms)
+		if !IsEqualStatements(NewExpressionStatement(all), NewExpressionStatement(test.all)) {
+			t.Errorf("EvalProgramAll \"%v\" gives \"%#v\", expected \"%#v\"", test.program, all, test.all)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	src := "; header\n(and !a\n  \"b c\") !d ; same line\n#| note |# (or (not !e) 1.5)\n\"tail\" ; kept\n; dropped"
+	forms, err := ParseProgram(src)
+	if err != nil {
+		t.Fatalf("ParseProgram error \"%v\"", err)
+	}
+	forms[len(forms)-1].editSource(func(info *SourceInfo) { // Decoder drops comments after the last line of the last form
+		info.Trailing = info.Trailing[:1]
+	})
+	for _, r := range []io.Reader{strings.NewReader(src), iotest.OneByteReader(strings.NewReader(src))} {
+		dec := NewDecoder(r)
+		i := 0
+		for dec.More() {
+			stm, err := dec.Decode()
+			if err != nil {
+				t.Fatalf("Decode error \"%v\"", err)
+			}
+			if i >= len(forms) || !reflect.DeepEqual(stm, forms[i]) {
+				t.Errorf("Decode form %d gives \"%#v\"", i, stm)
+			}
+			i++
+		}
+		if i != len(forms) {
+			t.Errorf("Decode gives %d forms, expected %d", i, len(forms))
+		}
+		if _, err := dec.Decode(); err != io.EOF {
+			t.Errorf("Decode at end error is \"%v\", expected EOF", err)
+		}
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	var tests = []struct {
+		inp     string
+		forms   int
+		err     error
+		message string
+	}{
+		{"(a)\n(b (c)\n", 1, ErrorEndOfExpression, "3:1: unexprected end of expression\n\n^"},
+		{"(a) x) (b)", 2, ErrorExpectOpen, "1:6: expected opening parenthesis\n(a) x) (b)\n     ^"},
+		{"'a `(b ,c) ; x\n '", 2, ErrorEndOfExpression, ""},
+		{"(a \"b\n c", 0, ErrorUnterminatedString, "1:4: unterminated string literal\n(a \"b\n   ^"},
+		{"(a \"\\x\") (b)", 0, ErrorInvalidEscape,
+			"1:4: invalid escape sequence in string literal\n(a \"\\x\") (b)\n   ^"},
+		{strings.Repeat("a ", 5000) + "#| x", 5000, ErrorUnterminatedComment, ""},
+	}
+	for _, test := range tests {
+		dec := NewDecoder(strings.NewReader(test.inp))
+		n := 0
+		var err error
+		for ; ; n++ {
+			if _, err = dec.Decode(); err != nil {
+				break
+			}
+		}
+		if n != test.forms || !errors.Is(err, test.err) {
+			t.Errorf("Decode \"%.20v\" gives %d forms and \"%v\", expected %d and \"%v\"",
+				test.inp, n, err, test.forms, test.err)
+		}
+		if test.message != "" && err.Error() != test.message {
+			t.Errorf("Decode \"%v\" error \"%v\", expected \"%v\"", test.inp, err, test.message)
+		}
+		if _, again := dec.Decode(); again != err {
+			t.Errorf("Decode \"%.20v\" error is not sticky: \"%v\"", test.inp, again)
+		}
+	}
+	// snippet of a long line keeps only its tail
+	var err error
+	var perr *ParseError
+	dec := NewDecoder(strings.NewReader(strings.Repeat("a ", 5000) + "#| x"))
+	for err == nil {
+		_, err = dec.Decode()
+	}
+	if !errors.As(err, &perr) || perr.Pos.Column != 10001 ||
+		!strings.HasSuffix(perr.Snippet(), "a a #| x\n"+strings.Repeat(" ", len(perr.Line)-4)+"^") {
+		t.Errorf("Decode long line error \"%#v\"", err)
+	}
+}
+
+// Rule set of n forms, about 150 bytes each
+func largeProgram(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "; rule %d\n(if (and !a%d (or (not !b) \"New York\")) (fand 0.5 %d) #| why |# \"x\\ny\")\n", i, i, i)
+	}
+	return b.String()
+}
+
+func BenchmarkSplitToTokens(b *testing.B) {
+	src := largeProgram(10000)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := splitToTokens(src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseProgram(b *testing.B) {
+	src := largeProgram(10000)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseProgram(src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	src := "(and " + strings.Repeat("(or !a (not !b) \"c d\" 1.5) ", 10000) + ")"
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	src := largeProgram(10000)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dec := NewDecoder(strings.NewReader(src))
+		for {
+			if _, err := dec.Decode(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{"", "(", ")", "a b", "(f \"x\\u00e9\" ; c\n #| #| |# |# 1 2.5 !k)",
+		"\"\\", "#|", "(a)(b", "\xff(\xfe)", largeProgram(2),
+		"(f [1 2.5] {a:0.5 \"b c\": 1})", "[1 {", "{a:1]", "'a `(b ,c ,@d) ',(e)", "'0[\""} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		if ast, err := Parse(src); err == nil {
+			again, err := Parse(Format(ast))
+			if err != nil || !reflect.DeepEqual(stripSource(again), stripSource(ast)) {
+				t.Errorf("Parse(Format(\"%q\")) gives \"%v\" (%v), expected \"%v\"", src, again, err, ast)
+			}
+		}
+		forms, err := ParseProgram(src)
+		dec := NewDecoder(strings.NewReader(src))
+		n := 0
+		for ; ; n++ {
+			_, derr := dec.Decode()
+			if derr == io.EOF {
+				break
+			}
+			if derr != nil {
+				if err == nil {
+					t.Errorf("Decode \"%q\" error \"%v\", ParseProgram succeeded", src, derr)
+				}
+				return
+			}
+		}
+		if err != nil {
+			t.Errorf("ParseProgram \"%q\" error \"%v\", Decoder succeeded", src, err)
+		} else if n != len(forms) {
+			t.Errorf("Decode \"%q\" gives %d forms, ParseProgram %d", src, n, len(forms))
+		}
+	})
+}
+
+func TestFormat(t *testing.T) {
+	var tests = []struct {
+		inp  Statement
+		outp string
+	}{
+		{NewExpressionStatement([]Statement{
+			NewStringStatement("if"),
+			NewExpressionStatement([]Statement{NewStringStatement("and"), NewStringStatement("!a"),
+				NewQuotedStringStatement("New York")}),
+			NewIntStatement(-3),
+			NewFloatStatement(4.0),
+			NewBoolStatement(true),
+		}), `(if (and !a "New York") -3 4.0 true)`},
+		{NewExpressionStatement([]Statement{NewStringStatement("42"), NewStringStatement("42"),
+			NewStringStatement("true"), NewStringStatement(""), NewStringStatement("a b")}),
+			`(42 "42" "true" "" "a b")`},
+		{NewStringStatement("tab\there \"q\" \\ \x01 é"), `"tab\there \"q\" \\ \u0001 é"`},
+		{NewStringStatement("#|x"), `"#|x"`},
+		{NewExpressionStatement([]Statement{NewStringStatement(",x"), NewStringStatement("'a"),
+			NewStringStatement("a'b")}), `(",x" "'a" a'b)`},
+		{NewFloatStatement(0.1), "0.1"},
+		{NewFloatStatement(1e20), "1e+20"},
+		{NewFloatStatement(float32(math.Inf(-1))), "-Inf"},
+		{NewFloatArrayStatement([]float32{1, 0.5}), "[1.0 0.5]"},
+		{NewFloatArrayStatement([]float32{}), "[]"},
+		{NewFuzzyStatement(NewFuzzySet(false, FuzzyElement{NewStringStatement("low"), 0.25},
+			FuzzyElement{NewStringStatement("New York"), 0.75})), `{low:0.25 "New York":0.75}`},
+		{NewListStatement([]Statement{NewIntStatement(1), NewQuotedStringStatement("u"),
+			NewListStatement([]Statement{})}), `(list 1 "u" (list))`},
+		{NewMapStatement(map[string]Statement{"tier": NewStringStatement("gold"), "42": NewIntStatement(41)}),
+			`(hash-map "42" 41 tier gold)`},
+		{NewListStatement([]Statement{NewStringStatement("x y"), NewStringStatement("!k")}), `(list "x y" "!k")`},
+		{NewMapStatement(map[string]Statement{"!a": NewStringStatement("!b")}), `(hash-map "!a" "!b")`},
+		{NewErrorStatement(fmt.Errorf("bad |# value")), "#| error: bad | # value |#"},
+		{NewExpressionStatement([]Statement{NewStringStatement("f"), NewNilStatement(), NewStringStatement("nil")}),
+			`(f nil "nil")`},
+		{Statement{}, "#| unknown: <nil> |#"},
+	}
+	for _, test := range tests {
+		if x := Format(test.inp); x != test.outp {
+			t.Errorf("Format \"%#v\" gives \"%v\", expected \"%v\"", test.inp, x, test.outp)
+		}
+		if x := test.inp.String(); x != test.outp {
+			t.Errorf("String \"%#v\" gives \"%v\", expected \"%v\"", test.inp, x, test.outp)
+		}
+	}
+	// lists and maps evaluate to the same value, strings like `env' references are kept
+	env := Environment{"k": NewIntStatement(1), "a": NewIntStatement(2), "b": NewIntStatement(3)}
+	funcs := FunctionMap{}
+	for _, m := range []FunctionMap{ListFunctions, MapFunctions} {
+		for k, v := range m {
+			funcs[k] = v
+		}
+	}
+	for _, v := range []Statement{
+		NewListStatement([]Statement{NewStringStatement("x y"), NewStringStatement("!k")}),
+		NewMapStatement(map[string]Statement{"!a": NewStringStatement("!b")}),
+	} {
+		for _, text := range []string{Format(v), Pretty(v, 8)} {
+			if x := Eval(&funcs, &env, mustParse(t, text)); !IsEqualStatements(x, v) {
+				t.Errorf("Eval \"%v\" gives \"%v\", expected \"%v\"", text, x, v)
+			}
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	var tests = []string{
+		`(if (and !a "New York") -3 4.0 true)`,
+		"(f\n  ; comment\n  a \"\\u0001\\n\" 1e-7 2147483647 -0.0 NaN +Inf \"\xff\")",
+		`("quoted head" (nested (deeper "!not-env")) !env)`,
+		`"!top"`,
+		"atom",
+		`(f [0.1 2 -3e2] [] {low:0.2 mid: 0.5 "New York":0.3 "":1 12:30:0 1:1 "1":1 true:0.5})`,
+		largeProgram(1)[9:],
+	}
+	for _, src := range tests {
+		ast, err := Parse(src)
+		if err != nil {
+			t.Fatalf("Parse \"%v\" error \"%v\"", src, err)
+		}
+		again, err := Parse(Format(ast))
+		if err != nil || !reflect.DeepEqual(stripSource(again), stripSource(ast)) {
+			t.Errorf("Parse(Format(\"%v\")) gives \"%v\" (%v), expected \"%v\"", src, again, err, ast)
+		}
+	}
+}
+
+func TestPretty(t *testing.T) {
+	var tests = []struct {
+		inp   string
+		width int
+		outp  string
+	}{
+		{"(and !a   (or !b !c))", 80, "(and !a (or !b !c))"},
+		{"(and !a (or !b !c))", 13, "(and\n  !a\n  (or !b !c))"},
+		{"(and !a (or !b !c))", 8, "(and\n  !a\n  (or\n    !b\n    !c))"},
+		{"(if (and (or !gold !platinum) (not !blocked)) \"approve\" \"reject\")", 43,
+			"(if\n  (and (or !gold !platinum) (not !blocked))\n  \"approve\"\n  \"reject\")"},
+		{"; head\n(and #| a |# !a ; tail\n) ; end", 80,
+			"; head\n(and #| a |#\n  !a ; tail\n) ; end"},
+		{"(f (g) ; c\n)", 80, "(f\n  (g) ; c\n)"},
+		{"(f (g) ; c\n ; own line\n)", 80, "(f\n  (g) ; c\n  ; own line\n)"},
+		{"(and ; why\n !a !b)", 80, "(and ; why\n  !a\n  !b)"},
+		{"[1 ; one\n 2]", 80, "[1 2] ; one"},
+		{"(f {a:1 #| x |#\n ; y\n b:0} c)", 80, "(f\n  {a:1 b:0} #| x |#\n  ; y\n  c)"},
+		{"(defmacro m (x) `(+ ,x 1))", 12, "(defmacro\n  m\n  (x)\n  `(+ ,x 1))"},
+		{"(f (quote x) (unquote @a) (quote a b) ' ; why\n y)", 80, "(f\n  'x\n  (unquote @a)\n  (quote a b)\n  '; why\n  y)"},
+		{"()", 80, "()"},
+		{"atom", 1, "atom"},
+	}
+	for _, test := range tests {
+		ast, err := Parse(test.inp)
+		if err != nil {
+			t.Fatalf("Parse \"%v\" error \"%v\"", test.inp, err)
+		}
+		x := Pretty(ast, test.width)
+		if x != test.outp {
+			t.Errorf("Pretty \"%v\" gives \"%v\", expected \"%v\"", test.inp, x, test.outp)
+		}
+		again, err := Parse(x)
+		if err != nil || Pretty(again, test.width) != x {
+			t.Errorf("Pretty \"%v\" is not stable: \"%v\" (%v)", test.inp, Pretty(again, test.width), err)
+		}
+	}
+	program, _ := ParseProgram("(a) ; x\n(b c)")
+	if x := PrettyProgram(program, 80); x != "(a) ; x\n\n(b c)\n" {
+		t.Errorf("PrettyProgram gives \"%v\"", x)
+	}
+}
+
+// Drop positions and comments to compare statements from different sources
+func stripSource(s Statement) Statement {
+	if s.Source != nil {
+		s.editSource(func(info *SourceInfo) { info.Comments, info.Trailing = nil, nil })
+	}
+	s = clearPos(s)
+	if s.Type() == STExpression {
+		e := s.ValueExpression()
+		for i := range e {
+			e[i] = stripSource(e[i])
+		}
+	}
+	if s.Type() == STFloat && s.ValueFloat() != s.ValueFloat() { // NaN is not equal to itself
+		s.Value = "NaN"
+	}
+	return s
+}
+
 func TestEval(t *testing.T) {
 	var tests = []struct {
 		program string
@@ -151,6 +817,32 @@ func TestEval(t *testing.T) {
 			Environment{"somekey": NewStringStatement("somevalue")},
 			NewErrorStatement(fmt.Errorf("environment key `nokey' not found")),
 		},
+		{`"!somekey"`,
+			FunctionMap{},
+			Environment{"somekey": NewStringStatement("somevalue")},
+			NewStringStatement("!somekey"),
+		},
+		{`""`,
+			FunctionMap{},
+			Environment{},
+			NewStringStatement(""),
+		},
+		{"{low:0.25 high:0.75}",
+			FunctionMap{},
+			Environment{},
+			NewFuzzyStatement(NewFuzzySet(false, FuzzyElement{NewStringStatement("low"), 0.25},
+				FuzzyElement{NewStringStatement("high"), 0.75})),
+		},
+		{"[1 2]",
+			FunctionMap{},
+			Environment{},
+			NewFloatArrayStatement([]float32{1, 2}),
+		},
+		{`(env "some key")`,
+			FunctionMap{},
+			Environment{"some key": NewStringStatement("somevalue")},
+			NewStringStatement("somevalue"),
+		},
 	}
 	for _, test := range tests {
 		ast, _ := Parse(test.program)
@@ -163,6 +855,62 @@ func TestEval(t *testing.T) {
 
 }
 
+func TestEvalBranchForms(t *testing.T) {
+	env := Environment{
+		"score": NewIntStatement(72),
+		"tier":  NewStringStatement("gold"),
+		"limit": NewIntStatement(72),
+		"flag":  NewBoolStatement(true),
+	}
+	funcs := FunctionMap{}
+	for _, m := range []FunctionMap{ComparisonFunctions, StandartLogicFunctions} {
+		for k, v := range m {
+			funcs[k] = v
+		}
+	}
+	var tests = []struct {
+		program string
+		result  Statement
+	}{
+		{`(cond ((>= !score 90) A) ((>= !score 70) B) (else C))`, NewStringStatement("B")},
+		{`(cond ((>= !score 90) A) (else !missing C))`, NewErrorStatement(fmt.Errorf("environment key `missing' not found"))},
+		{`(cond (false !missing) (!flag first second))`, NewStringStatement("second")},
+		{`(cond (!missing? 1) (true 2))`, NewIntStatement(2)},
+		{`(cond ((< !score 0) neg))`, NewNilStatement()},
+		{`(cond (1 a))`, NewErrorStatement(fmt.Errorf("function `cond' expect bool param in condition"))},
+		{`(cond (true))`, NewErrorStatement(fmt.Errorf("function `cond' expect (test body...) clause"))},
+		{`(cond (else 1) (true 2))`, NewErrorStatement(fmt.Errorf("function `cond' expect else clause to be the last"))},
+		{`(case !tier ((platinum gold) 0.2) (silver 0.1) (else 0))`, NewFloatStatement(0.2)},
+		{`(case !tier (("gold") "quoted") (else !missing))`, NewStringStatement("quoted")},
+		{`(case !score ((1 2 3) low) (72 exact) (else !missing))`, NewStringStatement("exact")},
+		{`(case 72.0 ((72) number))`, NewStringStatement("number")},
+		{`(case !tier ((!tier) env) (else none))`, NewStringStatement("none")},
+		{`(case !tier (bronze 1))`, NewNilStatement()},
+		{`(case !tier bronze)`, NewErrorStatement(fmt.Errorf("function `case' expect (value body...) clause"))},
+		{`(switch !score (!limit at-limit) (else other))`, NewStringStatement("at-limit")},
+		{`(switch !tier ((if !flag silver gold) s) (gold g) (!missing m))`, NewStringStatement("g")},
+		{`(switch !tier (!missing m))`, NewErrorStatement(fmt.Errorf("environment key `missing' not found"))},
+		{`(switch)`, NewErrorStatement(fmt.Errorf("function `switch' required at least one param"))},
+		{`(when !flag a b)`, NewStringStatement("b")},
+		{`(when (not !flag) !missing)`, NewNilStatement()},
+		{`(unless !flag !missing)`, NewNilStatement()},
+		{`(unless !missing? yes)`, NewStringStatement("yes")},
+		{`(when !flag)`, NewErrorStatement(fmt.Errorf("function `when' required test and body"))},
+		{`(unless !tier 1)`, NewErrorStatement(fmt.Errorf("function `unless' expect bool param in condition"))},
+	}
+	for _, test := range tests {
+		ast, err := Parse(test.program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val := Eval(&funcs, &env, &ast)
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(branch) \"%v\" gives \"%v\", expected \"%v\"",
+				test.program, val, test.result)
+		}
+	}
+}
+
 func TestEvalStandartLogicFunctions(t *testing.T) {
 	var tests = []struct {
 		program string
@@ -234,6 +982,47 @@ func TestEvalStandartLogicFunctions(t *testing.T) {
 			Environment{"a": NewBoolStatement(true), "b": NewStringStatement("Here")},
 			NewStringStatement("b"),
 		},
+		// nil
+		{"(if !a? b c)",
+			StandartLogicFunctions,
+			Environment{},
+			NewStringStatement("c"),
+		},
+		{"(or (not nil) !a)",
+			StandartLogicFunctions,
+			Environment{},
+			NewBoolStatement(true),
+		},
+		{"(and !a? true)",
+			StandartLogicFunctions,
+			Environment{"a": NewNilStatement()},
+			NewBoolStatement(false),
+		},
+		{"(nil? !a?)",
+			StandartLogicFunctions,
+			Environment{},
+			NewBoolStatement(true),
+		},
+		{"(nil? \"nil\")",
+			StandartLogicFunctions,
+			Environment{},
+			NewBoolStatement(false),
+		},
+		{"(coalesce !a? !b? default)",
+			StandartLogicFunctions,
+			Environment{"b": NewIntStatement(5)},
+			NewIntStatement(5),
+		},
+		{"(coalesce !a? nil)",
+			StandartLogicFunctions,
+			Environment{},
+			NewNilStatement(),
+		},
+		{"(coalesce !a? !b !c)",
+			StandartLogicFunctions,
+			Environment{"c": NewIntStatement(5)},
+			NewErrorStatement(fmt.Errorf("environment key `b' not found")),
+		},
 	}
 	for _, test := range tests {
 		ast, _ := Parse(test.program)
@@ -245,24 +1034,1084 @@ func TestEvalStandartLogicFunctions(t *testing.T) {
 	}
 }
 
-func TestEvalFuzzyLogic(t *testing.T) {
+func TestEvalArithmetic(t *testing.T) {
 	var tests = []struct {
 		program string
-		funcs   FunctionMap
 		env     Environment
 		result  Statement
 	}{
-		{"(fand (env a) (env b))",
-			FuzzyLogicFunctions,
-			Environment{"a": NewFloatStatement(1.0), "b": NewFloatStatement(1.0)},
-			NewFloatStatement(1.0),
-		},
-		{"(fand (env a) (env b))",
-			FuzzyLogicFunctions,
-			Environment{"a": NewFloatStatement(0.9), "b": NewFloatStatement(0.5)},
-			NewFloatStatement(0.5),
-		},
-		{"(for (env a) (env b) (env c))",
+		{"(+ 1 2 3)", nil, NewIntStatement(6)},
+		{"(+ 1 2.5)", nil, NewFloatStatement(3.5)},
+		{"(+ 1 !a)", Environment{"a": NewFloat64Statement(0.1)}, NewFloat64Statement(1.1)},
+		{"(- 10 1 2)", nil, NewIntStatement(7)},
+		{"(- !a)", Environment{"a": NewIntStatement(5)}, NewIntStatement(-5)},
+		{"(* 2 3 4)", nil, NewIntStatement(24)},
+		{"(/ 10 4)", nil, NewFloat64Statement(2.5)},
+		{"(/ 4)", nil, NewFloat64Statement(0.25)},
+		{"(/ 1 3)", nil, NewFloat64Statement(1.0 / 3)},
+		{"(/ 16777217 1)", nil, NewFloat64Statement(16777217)},
+		{"(/ 1 0)", nil, NewErrorStatement(fmt.Errorf("function `/' division by zero"))},
+		{"(mod 7 3)", nil, NewIntStatement(1)},
+		{"(mod -7 3)", nil, NewIntStatement(2)},
+		{"(mod 7.5 2)", nil, NewFloatStatement(1.5)},
+		{"(mod 7 0)", nil, NewErrorStatement(fmt.Errorf("function `mod' division by zero"))},
+		{"(+ 9223372036854775807 1)", nil, NewErrorStatement(fmt.Errorf("function `+' integer overflow"))},
+		{"(* 4611686018427387904 2)", nil, NewErrorStatement(fmt.Errorf("function `*' integer overflow"))},
+		{"(abs -3)", nil, NewIntStatement(3)},
+		{"(abs -2.5)", nil, NewFloatStatement(2.5)},
+		{"(min 3 1.5 2)", nil, NewFloatStatement(1.5)},
+		{"(max 3 1 2)", nil, NewIntStatement(3)},
+		{"(round 2.5)", nil, NewIntStatement(3)},
+		{"(round 2.345 2)", nil, NewFloatStatement(2.35)},
+		{"(round 1250 -2)", nil, NewIntStatement(1300)},
+		{"(+ [1 2] [0.5 0.25])", nil, NewFloatArrayStatement([]float32{1.5, 2.25})},
+		{"(* [1 2] 2)", nil, NewFloatArrayStatement([]float32{2, 4})},
+		{"(- 1 [0.25 0.5])", nil, NewFloatArrayStatement([]float32{0.75, 0.5})},
+		{"(+ [1 2] [1])", nil, NewErrorStatement(fmt.Errorf("function `+' float arrays of different length 2 and 1"))},
+		{"(+ 1 a)", nil, NewErrorStatement(fmt.Errorf("function `+' expect number param"))},
+		{"(+)", nil, NewErrorStatement(fmt.Errorf("function `+' required at least one param"))},
+		{"(+ 1 !b)", Environment{"b": NewErrorStatement(fmt.Errorf("Wow!"))}, NewErrorStatement(fmt.Errorf("Wow!"))},
+	}
+	for _, test := range tests {
+		ast, _ := Parse(test.program)
+		val := Eval(&ArithmeticFunctions, &test.env, &ast)
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(arithmetic) \"%v\" gives \"%#v\", expected \"%#v\"",
+				test.program, val, test.result)
+		}
+	}
+}
+
+func TestEvalComparison(t *testing.T) {
+	var tests = []struct {
+		program string
+		env     Environment
+		result  Statement
+	}{
+		{"(= 3 3.0)", nil, NewBoolStatement(true)},
+		{"(= !a 3 3)", Environment{"a": NewIntStatement(3)}, NewBoolStatement(true)},
+		{"(= 3 3 4)", nil, NewBoolStatement(false)},
+		{"(!= 3 3.5)", nil, NewBoolStatement(true)},
+		{"(!= 3 3.0)", nil, NewBoolStatement(false)},
+		{"(< 1 !x 10)", Environment{"x": NewFloatStatement(2.5)}, NewBoolStatement(true)},
+		{"(< 1 !x 10)", Environment{"x": NewIntStatement(10)}, NewBoolStatement(false)},
+		{"(<= 1 !x 10)", Environment{"x": NewIntStatement(10)}, NewBoolStatement(true)},
+		{"(> 3 2 1)", nil, NewBoolStatement(true)},
+		{"(>= 3 3 4)", nil, NewBoolStatement(false)},
+		{"(< apple banana)", nil, NewBoolStatement(true)},
+		{"(< \"Zeta\" \"alpha\")", nil, NewBoolStatement(true)},
+		{"(< true 0)", nil, NewBoolStatement(true)},
+		{"(< 1 !b)", Environment{"b": NewErrorStatement(fmt.Errorf("Wow!"))}, NewErrorStatement(fmt.Errorf("Wow!"))},
+		{"(< 2 1 !b)", Environment{"b": NewErrorStatement(fmt.Errorf("Wow!"))}, NewBoolStatement(false)},
+		{"(= 1)", nil, NewErrorStatement(fmt.Errorf("function `=' required at least 2 param"))},
+		{"(= !price 0.1)", Environment{"price": NewFloat64Statement(0.1)}, NewBoolStatement(true)},
+		{"(< 0.1 !price)", Environment{"price": NewFloat64Statement(0.1)}, NewBoolStatement(false)},
+		{"(< 0.1 !price)", Environment{"price": NewFloat64Statement(0.11)}, NewBoolStatement(true)},
+		{"(< nil 1)", nil, NewErrorStatement(fmt.Errorf("function `<' can not order nil"))},
+		{"(<= 1 !x)", Environment{"x": NewNilStatement()}, NewErrorStatement(fmt.Errorf("function `<=' can not order nil"))},
+		{"(> 2 1 nil)", nil, NewErrorStatement(fmt.Errorf("function `>' can not order nil"))},
+		{"(>= !x? 0)", nil, NewErrorStatement(fmt.Errorf("function `>=' can not order nil"))},
+		{"(= nil !x?)", nil, NewBoolStatement(true)},
+		{"(!= nil 0)", nil, NewBoolStatement(true)},
+	}
+	for _, test := range tests {
+		ast, _ := Parse(test.program)
+		val := Eval(&ComparisonFunctions, &test.env, &ast)
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(comparison) \"%v\" gives \"%#v\", expected \"%#v\"",
+				test.program, val, test.result)
+		}
+	}
+}
+
+func TestCompareStatements(t *testing.T) {
+	// in ascending order
+	var ordered = []Statement{
+		NewNilStatement(),
+		NewBoolStatement(false),
+		NewBoolStatement(true),
+		NewFloatStatement(float32(math.NaN())),
+		NewIntStatement(-5),
+		NewFloat64Statement(0.5),
+		NewIntStatement(1),
+		NewStringStatement(""),
+		NewStringStatement("a"),
+		NewStringStatement("ab"),
+		NewFloatArrayStatement([]float32{0.5}),
+		NewFloatArrayStatement([]float32{0.5, 0}),
+		NewFuzzyStatement(FuzzySetType{{NewStringStatement("a"), 0.5}}),
+		NewExpressionStatement([]Statement{NewStringStatement("f")}),
+		NewErrorStatement(fmt.Errorf("a")),
+		{Value: struct{}{}},
+	}
+	for i := range ordered {
+		for j := range ordered {
+			if c := CompareStatements(ordered[i], ordered[j]); c != cmp.Compare(i, j) {
+				t.Errorf("CompareStatements \"%#v\" \"%#v\" gives %d", ordered[i], ordered[j], c)
+			}
+		}
+	}
+	if CompareStatements(NewIntStatement(2), NewFloatStatement(2)) != 0 {
+		t.Errorf("CompareStatements 2 and 2.0 are not equal")
+	}
+}
+
+func TestEvalStringFunctions(t *testing.T) {
+	var tests = []struct {
+		program string
+		env     Environment
+		result  Statement
+	}{
+		{`(concat "AB-" !code "-" x)`, Environment{"code": NewStringStatement("42")}, NewStringStatement("AB-42-x")},
+		{`(concat "a" 1)`, nil, NewErrorStatement(fmt.Errorf("function `concat' expect string param"))},
+		{`(length "привет")`, nil, NewIntStatement(6)},
+		{`(length 5)`, nil, NewErrorStatement(fmt.Errorf("function `length' expect string param"))},
+		{`(length)`, nil, NewErrorStatement(fmt.Errorf("function `length' required one param"))},
+		{`(substring "привет" 1 3)`, nil, NewStringStatement("ри")},
+		{`(substring "abc" 1)`, nil, NewStringStatement("bc")},
+		{`(substring "abc" 2 5)`, nil, NewErrorStatement(fmt.Errorf("function `substring' range [2:5] out of length 3"))},
+		{`(upper "привет")`, nil, NewStringStatement("ПРИВЕТ")},
+		{`(lower "ABC")`, nil, NewStringStatement("abc")},
+		{`(trim "  a b\t")`, nil, NewStringStatement("a b")},
+		{`(trim "--a-" "-")`, nil, NewStringStatement("a")},
+		{`(starts-with? !code "AB")`, Environment{"code": NewStringStatement("AB-1")}, NewBoolStatement(true)},
+		{`(ends-with? "AB-1" "AB")`, nil, NewBoolStatement(false)},
+		{`(contains? "John Smith" "Smi")`, nil, NewBoolStatement(true)},
+		{`(split "a,b,,c" ",")`, nil, NewListStatement([]Statement{
+			NewStringStatement("a"), NewStringStatement("b"), NewStringStatement(""), NewStringStatement("c")})},
+		{`(join (split "a,b,c" ",") "-")`, nil, NewStringStatement("a-b-c")},
+		{`(replace "a.b.c" "." "/")`, nil, NewStringStatement("a/b/c")},
+		{`(replace "a.b.c" "." "/" 1)`, nil, NewStringStatement("a/b.c")},
+		{`(pad-left "7" 3 "0")`, nil, NewStringStatement("007")},
+		{`(pad-right "ab" 4)`, nil, NewStringStatement("ab  ")},
+		{`(pad-left "abcd" 2)`, nil, NewStringStatement("abcd")},
+		{`(pad-left "a" 3 "00")`, nil, NewErrorStatement(fmt.Errorf("function `pad-left' expect one rune to pad"))},
+		{`(format "%s-%05d %.2f%% %t %v" "AB" 42 0.5 true [1 2])`, nil, NewStringStatement("AB-00042 0.50% true [1.0 2.0]")},
+		{`(format "%d" "x")`, nil, NewErrorStatement(errors.New("function `format' verb %d does not accept \"x\" param"))},
+		{`(format "%s %s" "x")`, nil, NewErrorStatement(errors.New("function `format' missing param for %s"))},
+		{`(format "%s" "x" "y")`, nil, NewErrorStatement(fmt.Errorf("function `format' too many params for pattern"))},
+		{`(format "%999999999d" 1)`, nil, NewErrorStatement(errors.New("function `format' width or precision is too large"))},
+		{`(format "%.99999999999999999999f" 1.5)`, nil, NewErrorStatement(errors.New("function `format' width or precision is too large"))},
+		{`(format "%065536.3f|" 1.5)`, nil, NewStringStatement(strings.Repeat("0", 65531) + "1.500|")},
+		{`(format "%[1]s" "x")`, nil, NewErrorStatement(errors.New("function `format' unsupported verb %["))},
+		{`(upper !b)`, Environment{"b": NewErrorStatement(fmt.Errorf("Wow!"))}, NewErrorStatement(fmt.Errorf("Wow!"))},
+	}
+	for _, test := range tests {
+		ast, _ := Parse(test.program)
+		val := Eval(&StringFunctions, &test.env, &ast)
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(string) \"%v\" gives \"%#v\", expected \"%#v\"",
+				test.program, val, test.result)
+		}
+	}
+}
+
+func TestEvalRegexpFunctions(t *testing.T) {
+	var tests = []struct {
+		program string
+		env     Environment
+		result  Statement
+	}{
+		{`(re-match "^AB-[0-9]+$" !code)`, Environment{"code": NewStringStatement("AB-42")}, NewBoolStatement(true)},
+		{`(re-match "^AB-[0-9]+$" "AB-4x")`, nil, NewBoolStatement(false)},
+		{`(re-find "[0-9]+" "AB-42-7")`, nil, NewStringStatement("42")},
+		{`(re-find "[0-9]+" "AB")`, nil, NewStringStatement("")},
+		{`(re-groups "(\\w+)-(\\d+)" "x AB-42")`, nil, NewListStatement([]Statement{
+			NewStringStatement("AB-42"), NewStringStatement("AB"), NewStringStatement("42")})},
+		{`(re-groups "z" "AB")`, nil, NewListStatement([]Statement{})},
+		{`(re-replace "(\\w+) (\\w+)" "John Smith" "$2, $1")`, nil, NewStringStatement("Smith, John")},
+		{`(re-match "(a" "a")`, nil, NewErrorStatement(fmt.Errorf("function `re-match' error parsing regexp: missing closing ): `(a`"))},
+		{`(re-match "(abcdefghijklmn){1000}" "a")`, nil, NewErrorStatement(fmt.Errorf("function `re-match' pattern is too complex"))},
+		{fmt.Sprintf(`(re-find "%s" "a")`, strings.Repeat("a", MaxRegexpLength+1)), nil,
+			NewErrorStatement(fmt.Errorf("function `re-find' pattern is too long"))},
+		{`(re-match 1 "a")`, nil, NewErrorStatement(fmt.Errorf("function `re-match' expect string param"))},
+		{`(re-match "a")`, nil, NewErrorStatement(fmt.Errorf("function `re-match' required 2 param"))},
+	}
+	for _, test := range tests {
+		ast, _ := Parse(test.program)
+		for i := 0; i < 2; i++ { // compiled and cached
+			val := Eval(&RegexpFunctions, &test.env, &ast)
+			if !IsEqualStatements(val, test.result) {
+				t.Errorf("Eval(regexp) \"%v\" gives \"%#v\", expected \"%#v\"",
+					test.program, val, test.result)
+			}
+		}
+	}
+}
+
+func TestRegexpCache(t *testing.T) {
+	c := newRegexpCache(2)
+	re1, _ := c.compile("a")
+	c.compile("b")
+	if re, _ := c.compile("a"); re != re1 {
+		t.Errorf("regexp cache does not keep recent pattern")
+	}
+	c.compile("c") // drops "b"
+	if _, ok := c.items["b"]; ok || c.order.Len() != 2 {
+		t.Errorf("regexp cache does not drop least recent pattern")
+	}
+	if _, err := c.compile("(a"); err == nil {
+		t.Errorf("regexp cache compiles invalid pattern")
+	}
+}
+
+func TestEvalListFunctions(t *testing.T) {
+	abc := NewListStatement([]Statement{NewStringStatement("a"), NewIntStatement(2), NewFloatStatement(3)})
+	var tests = []struct {
+		program string
+		env     Environment
+		result  Statement
+	}{
+		{`(list a 2 3.0)`, nil, abc},
+		{`(list)`, nil, NewListStatement([]Statement{})},
+		{`(list 1 !e)`, Environment{"e": NewErrorStatement(fmt.Errorf("Wow!"))}, NewErrorStatement(fmt.Errorf("Wow!"))},
+		{`(first !l)`, Environment{"l": abc}, NewStringStatement("a")},
+		{`(first (list))`, nil, NewErrorStatement(fmt.Errorf("function `first' got empty list"))},
+		{`(rest !l)`, Environment{"l": abc}, NewListStatement([]Statement{NewIntStatement(2), NewFloatStatement(3)})},
+		{`(rest (list))`, nil, NewListStatement([]Statement{})},
+		{`(nth !l 1)`, Environment{"l": abc}, NewIntStatement(2)},
+		{`(nth !l 3)`, Environment{"l": abc}, NewErrorStatement(fmt.Errorf("function `nth' index 3 out of length 3"))},
+		{`(len !l)`, Environment{"l": abc}, NewIntStatement(3)},
+		{`(len "привет")`, nil, NewIntStatement(6)},
+		{`(len 1)`, nil, NewErrorStatement(fmt.Errorf("function `len' expect list, string or float array param"))},
+		{`(append (list 1) 2 (list 3))`, nil, NewListStatement([]Statement{
+			NewIntStatement(1), NewIntStatement(2), NewListStatement([]Statement{NewIntStatement(3)})})},
+		{`(append 1 2)`, nil, NewErrorStatement(fmt.Errorf("function `append' expect list param"))},
+		{`(reverse !l)`, Environment{"l": abc}, NewListStatement([]Statement{
+			NewFloatStatement(3), NewIntStatement(2), NewStringStatement("a")})},
+		{`(contains? !l 3)`, Environment{"l": abc}, NewBoolStatement(true)},
+		{`(contains? !l b)`, Environment{"l": abc}, NewBoolStatement(false)},
+		{`(contains? !l 0.1)`, Environment{"l": NewListStatement([]Statement{NewFloat64Statement(0.1)})}, NewBoolStatement(true)},
+		{`(contains? "abc" "bc")`, nil, NewBoolStatement(true)},
+		{`(index-of !l 2.0)`, Environment{"l": abc}, NewIntStatement(1)},
+		{`(index-of !l 5)`, Environment{"l": abc}, NewIntStatement(-1)},
+		{`(first 1)`, nil, NewErrorStatement(fmt.Errorf("function `first' expect list param"))},
+	}
+	for _, test := range tests {
+		ast, _ := Parse(test.program)
+		val := Eval(&ListFunctions, &test.env, &ast)
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(list) \"%v\" gives \"%#v\", expected \"%#v\"",
+				test.program, val, test.result)
+		}
+	}
+	// appended list does not share memory with its source
+	env := Environment{"l": NewListStatement(make([]Statement, 1, 4))}
+	ast, _ := Parse("(append (rest !l) 1)")
+	Eval(&ListFunctions, &env, &ast)
+	ast, _ = Parse("(append !l 2)")
+	if val := Eval(&ListFunctions, &env, &ast); val.ValueList()[1].ValueInt() != 2 {
+		t.Errorf("append changes its source list")
+	}
+}
+
+func TestEvalMapFunctions(t *testing.T) {
+	customer := NewMapStatement(map[string]Statement{
+		"tier": NewStringStatement("gold"),
+		"age":  NewIntStatement(41),
+		"orders": NewListStatement([]Statement{
+			NewMapStatement(map[string]Statement{"total": NewFloatStatement(9.5)}),
+		}),
+	})
+	env := Environment{"customer": customer}
+	var tests = []struct {
+		program string
+		result  Statement
+	}{
+		{`(get !customer tier)`, NewStringStatement("gold")},
+		{`(get !customer "name")`, NewErrorStatement(fmt.Errorf("function `get' key not found: name"))},
+		{`(get !customer name anonymous)`, NewStringStatement("anonymous")},
+		{`(get !customer 1)`, NewErrorStatement(fmt.Errorf("function `get' expect string key for map and int index for list"))},
+		{`(get tier 1)`, NewErrorStatement(fmt.Errorf("function `get' expect map or list"))},
+		{`(get-in !customer orders 0 total)`, NewFloatStatement(9.5)},
+		{`(get-in !customer orders 1 total)`, NewErrorStatement(fmt.Errorf("function `get-in' key not found: 1"))},
+		{`(keys !customer)`, NewListStatement([]Statement{
+			NewStringStatement("age"), NewStringStatement("orders"), NewStringStatement("tier")})},
+		{`(has? !customer age)`, NewBoolStatement(true)},
+		{`(has? !customer name)`, NewBoolStatement(false)},
+		{`(has? (get !customer orders) 0)`, NewBoolStatement(true)},
+		{`(hash-map a 1 b (hash-map))`, NewMapStatement(map[string]Statement{
+			"a": NewIntStatement(1), "b": NewMapStatement(map[string]Statement{})})},
+		{`(hash-map a)`, NewErrorStatement(fmt.Errorf("function `hash-map' required even number of param"))},
+		{`(hash-map 1 a)`, NewErrorStatement(fmt.Errorf("function `hash-map' expect string key"))},
+	}
+	for _, test := range tests {
+		ast, _ := Parse(test.program)
+		val := Eval(&MapFunctions, &env, &ast)
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(map) \"%v\" gives \"%#v\", expected \"%#v\"",
+				test.program, val, test.result)
+		}
+	}
+}
+
+func TestJsonObjects(t *testing.T) {
+	var inp map[string]interface{}
+	err := json.Unmarshal([]byte(`{"customer": {"tier": "gold", "age": 41, "address": {"city": "Omsk"}},
+		"risk": {"low": 0.25, "high": 0.75}, "weights": {"a": 1}}`), &inp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := NewMapStatement(map[string]Statement{"city": NewStringStatement("Omsk")})
+	customer := NewMapStatement(map[string]Statement{
+		"tier": NewStringStatement("gold"), "age": NewIntStatement(41), "address": address})
+	risk := NewFuzzyStatement(FuzzySetType{{NewStringStatement("high"), 0.75}, {NewStringStatement("low"), 0.25}})
+	weights := NewFuzzyStatement(FuzzySetType{{NewStringStatement("a"), 1}})
+	var tests = []struct {
+		opts JsonOptions
+		outp Environment
+	}{
+		{JsonOptions{}, Environment{
+			"customer": NewFuzzyStatement(FuzzySetType{{NewStringStatement("age"), 41}}),
+			"risk":     risk,
+			"weights":  weights,
+		}},
+		{JsonOptions{Objects: JsonAuto}, Environment{"customer": customer, "risk": risk, "weights": weights}},
+		{JsonOptions{Objects: JsonMap, Schema: map[string]JsonObjectKind{"risk": JsonFuzzy}}, Environment{
+			"customer": customer,
+			"risk":     risk,
+			"weights":  NewMapStatement(map[string]Statement{"a": NewIntStatement(1)}),
+		}},
+		{JsonOptions{Schema: map[string]JsonObjectKind{"customer": JsonMap, "customer.address": JsonMap}},
+			Environment{"customer": customer, "risk": risk, "weights": weights}},
+	}
+	for _, test := range tests {
+		env := JsonMapToEnvironmentWithOptions(inp, test.opts)
+		if !IsEqualStatements(NewMapStatement(env), NewMapStatement(test.outp)) {
+			t.Errorf("JsonMapToEnvironment %+v gives \"%v\", expected \"%v\"", test.opts, env, test.outp)
+		}
+	}
+}
+
+func TestEnvPath(t *testing.T) {
+	env := Environment{
+		"customer": NewMapStatement(map[string]Statement{"tier": NewStringStatement("gold")}),
+		"orders": NewListStatement([]Statement{
+			NewMapStatement(map[string]Statement{"total": NewFloatStatement(9.5)}),
+		}),
+		"data":         NewMapStatement(map[string]Statement{"a.b": NewListStatement([]Statement{NewIntStatement(7)})}),
+		"flat.key":     NewIntStatement(1),
+		"customer.age": NewIntStatement(41),
+	}
+	var tests = []struct {
+		program string
+		result  Statement
+	}{
+		{`(env customer.tier)`, NewStringStatement("gold")},
+		{`!customer.tier`, NewStringStatement("gold")},
+		{`!orders[0].total`, NewFloatStatement(9.5)},
+		{`(env "orders[0].total")`, NewFloatStatement(9.5)},
+		{`!data["a.b"][0]`, NewIntStatement(7)},
+		{`!flat.key`, NewIntStatement(1)},
+		{`!customer.age`, NewIntStatement(41)},
+		{`!customer.name`, NewErrorStatement(fmt.Errorf("environment key `customer.name' not found"))},
+		{`!orders[1].total`, NewErrorStatement(fmt.Errorf("environment key `orders[1].total' not found"))},
+		{`!orders.total`, NewErrorStatement(fmt.Errorf("environment path `orders.total' expect string key for map and int index for list"))},
+		{`!customer.tier.x`, NewErrorStatement(fmt.Errorf("environment key `customer.tier.x' not found"))},
+		{`!orders[x]`, NewErrorStatement(fmt.Errorf("environment path `orders[x]' is invalid"))},
+		{`!orders[0]total`, NewErrorStatement(fmt.Errorf("environment path `orders[0]total' is invalid"))},
+		{`!customer..tier`, NewErrorStatement(fmt.Errorf("environment path `customer..tier' is invalid"))},
+		{`(has-env "a[")`, NewBoolStatement(false)},
+		{`(env "a[" 5)`, NewIntStatement(5)},
+		{`(env "a[\"\\q\"]" 5)`, NewIntStatement(5)},
+		{`!orders[x]?`, NewNilStatement()},
+		{`(has-env "orders.total")`, NewErrorStatement(fmt.Errorf("environment path `orders.total' expect string key for map and int index for list"))},
+	}
+	for _, test := range tests {
+		ast, err := Parse(test.program)
+		if err != nil {
+			t.Errorf("Parse \"%v\" gives error %v", test.program, err)
+			continue
+		}
+		if test.program[0] == '!' && Format(ast) != test.program {
+			t.Errorf("Format \"%v\" gives \"%v\"", test.program, Format(ast))
+		}
+		val := Eval(&FunctionMap{}, &env, &ast)
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(env path) \"%v\" gives \"%#v\", expected \"%#v\"",
+				test.program, val, test.result)
+		}
+	}
+}
+
+func TestEnvOptional(t *testing.T) {
+	env := Environment{
+		"a":        NewIntStatement(1),
+		"active?":  NewBoolStatement(true),
+		"customer": NewMapStatement(map[string]Statement{"tier": NewStringStatement("gold")}),
+	}
+	var tests = []struct {
+		program string
+		result  Statement
+	}{
+		{`(env a 0)`, NewIntStatement(1)},
+		{`(env b 0)`, NewIntStatement(0)},
+		{`(env b (env a))`, NewIntStatement(1)},
+		{`(env customer.age 18)`, NewIntStatement(18)},
+		{`(env customer.tier.x 0)`, NewIntStatement(0)},
+		{`(env b 1 2)`, NewErrorStatement(fmt.Errorf("function `env' expect 1 or 2 param"))},
+		{`!a?`, NewIntStatement(1)},
+		{`!b?`, NewNilStatement()},
+		{`!customer.age?`, NewNilStatement()},
+		{`!active?`, NewBoolStatement(true)},
+		{`!b`, NewErrorStatement(fmt.Errorf("environment key `b' not found"))},
+		{`(has-env a)`, NewBoolStatement(true)},
+		{`(has-env customer.tier)`, NewBoolStatement(true)},
+		{`(has-env customer.age)`, NewBoolStatement(false)},
+		{`(has-env "b")`, NewBoolStatement(false)},
+		{`(has-env 1)`, NewErrorStatement(fmt.Errorf("function `has-env' expect 1 param is string"))},
+	}
+	for _, test := range tests {
+		ast, _ := Parse(test.program)
+		val := Eval(&FunctionMap{}, &env, &ast)
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(env) \"%v\" gives \"%#v\", expected \"%#v\"",
+				test.program, val, test.result)
+		}
+	}
+	if _, err := env.GetPath("b"); !errors.Is(err, ErrorKeyNotFound) {
+		t.Errorf("GetPath gives error %v, expected ErrorKeyNotFound", err)
+	}
+	var inp map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"customer": null, "tags": ["a"]}`), &inp); err != nil {
+		t.Fatal(err)
+	}
+	sparse := JsonMapToEnvironment(inp)
+	for program, result := range map[string]Statement{
+		`!customer.tier?`:             NewNilStatement(),
+		`(env customer.tier unknown)`: NewStringStatement("unknown"),
+		`(has-env customer.tier)`:     NewBoolStatement(false),
+		`(has-env tags[0].name)`:      NewBoolStatement(false),
+		`(has-env tags.name)`: NewErrorStatement(fmt.Errorf(
+			"environment path `tags.name' expect string key for map and int index for list")),
+	} {
+		ast, _ := Parse(program)
+		if val := Eval(&FunctionMap{}, &sparse, &ast); !IsEqualStatements(val, result) {
+			t.Errorf("Eval(env) \"%v\" gives \"%v\", expected \"%v\"", program, val, result)
+		}
+	}
+}
+
+func TestLet(t *testing.T) {
+	env := Environment{
+		"a":     NewIntStatement(10),
+		"b":     NewIntStatement(4),
+		"order": NewMapStatement(map[string]Statement{"total": NewIntStatement(120)}),
+	}
+	funcs := FunctionMap{}
+	for _, m := range []FunctionMap{ArithmeticFunctions, ComparisonFunctions, StandartLogicFunctions} {
+		for k, v := range m {
+			funcs[k] = v
+		}
+	}
+	var tests = []struct {
+		program string
+		result  Statement
+	}{
+		{`(let ((r (/ !a !b))) (and (> !r 2) (< !r 3)))`, NewBoolStatement(true)},
+		{`(let ((a 1) (c (+ !a 1))) (+ !a !c))`, NewIntStatement(12)},
+		{`(let* ((a 1) (c (+ !a 1))) (+ !a !c))`, NewIntStatement(3)},
+		{`(let ((x 1)) (let ((x 2)) !x))`, NewIntStatement(2)},
+		{`(let ((x 1)) (let ((y 2)) (+ !x (env y))))`, NewIntStatement(3)},
+		{`(let ((t (env order))) !t.total)`, NewIntStatement(120)},
+		{`(let () 1 2)`, NewIntStatement(2)},
+		{`(let ((x 1)) !y?)`, NewNilStatement()},
+		{`(let ((x 1)) (let ((y 2)) !x?))`, NewIntStatement(1)},
+		{`(let ((x 1)) (env "\u0000parent"))`, NewErrorStatement(fmt.Errorf("environment key `\x00parent' not found"))},
+		{`(let ((x 1)) (has-env "\u0000parent"))`, NewBoolStatement(false)},
+		{`((lambda () (env "\u0000depth" 0)))`, NewIntStatement(0)},
+		{`(let ((t (env order))) (let ((x 1)) (+ !t.total !x)))`, NewIntStatement(121)},
+		{`(and (let ((x true)) !x) (not (has-env x)))`, NewBoolStatement(true)},
+		{`(let ((x (/ 1 0))) !x)`, NewErrorStatement(fmt.Errorf("function `/' division by zero"))},
+		{`(let ((x 1)))`, NewErrorStatement(fmt.Errorf("function `let' required bindings and body"))},
+		{`(let x 1)`, NewErrorStatement(fmt.Errorf("function `let' expect list of bindings"))},
+		{`(let* ((x)) 1)`, NewErrorStatement(fmt.Errorf("function `let*' expect (name value) binding"))},
+		{`(let (("x" 1)) 1)`, NewErrorStatement(fmt.Errorf("function `let' expect (name value) binding"))},
+		{`(let ((!x 1)) 1)`, NewErrorStatement(fmt.Errorf("function `let' expect (name value) binding"))},
+	}
+	for _, test := range tests {
+		ast, err := Parse(test.program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val := Eval(&funcs, &env, &ast)
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(let) \"%v\" gives \"%v\", expected \"%v\"",
+				test.program, val, test.result)
+		}
+	}
+	if len(env) != 3 {
+		t.Errorf("let changed environment: %v", env)
+	}
+	scope := env.Child().Child()
+	scope.Add("c", NewIntStatement(1))
+	if a, ok := scope.Get("a"); !ok || a.ValueInt() != 10 || len(scope) != 2 {
+		t.Errorf("Child scope gives a=%v %v, size %d", a, ok, len(scope))
+	}
+	if _, ok := env.Get("c"); ok {
+		t.Errorf("Child scope binding is visible in parent")
+	}
+}
+
+func TestLambda(t *testing.T) {
+	env := Environment{
+		"rate":  NewFloatStatement(0.5),
+		"total": NewIntStatement(120),
+		"sq":    Eval(&FunctionMap{}, &Environment{}, mustParse(t, `(lambda (x) (* !x !x))`)),
+	}
+	var tests = []struct {
+		program string
+		result  Statement
+	}{
+		{`((lambda (x y) (+ !x !y)) 1 2)`, NewIntStatement(3)},
+		{`((lambda () 7))`, NewIntStatement(7)},
+		{`(let ((add (lambda (x) (+ !x 1)))) (add (add 1)))`, NewIntStatement(3)},
+		{`(let* ((n 10) (addn (lambda (x) (+ !x !n)))) (let ((n 0)) (addn 1)))`, NewIntStatement(11)},
+		{`(sq 3)`, NewIntStatement(9)},
+		{`((lambda (x) !x))`, NewErrorStatement(fmt.Errorf("function `lambda' required 1 param"))},
+		{`(lambda x 1)`, NewErrorStatement(fmt.Errorf("function `lambda' expect list of params"))},
+		{`(lambda (x))`, NewErrorStatement(fmt.Errorf("function `lambda' required params and body"))},
+		{`(lambda ("x") 1)`, NewErrorStatement(fmt.Errorf("function `lambda' expect param name"))},
+		{`(let ((x 1)) (defun f () !x))`, NewErrorStatement(fmt.Errorf("function `defun' is allowed only at top level, see RegisterFunctions"))},
+		{`(rate 1)`, NewErrorStatement(fmt.Errorf("function rate not found"))},
+	}
+	for _, test := range tests {
+		funcs := FunctionMap{
+			"progn": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+				return EvalProgram(funcs, env, expr)
+			},
+		}
+		for _, m := range []FunctionMap{ArithmeticFunctions, ComparisonFunctions, StandartLogicFunctions} {
+			for k, v := range m {
+				funcs[k] = v
+			}
+		}
+		val := Eval(&funcs, &env, mustParse(t, test.program))
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(lambda) \"%v\" gives \"%v\", expected \"%v\"",
+				test.program, val, test.result)
+		}
+	}
+	if x := Format(env["sq"]); x != "(lambda (x) (* !x !x))" {
+		t.Errorf("Format function gives %v", x)
+	}
+	if CompareStatements(env["sq"], NewMapStatement(nil)) <= 0 || !IsEqualStatements(env["sq"], env["sq"]) {
+		t.Errorf("CompareStatements function is not after map")
+	}
+}
+
+func TestRegisterFunctions(t *testing.T) {
+	program, err := ParseProgram(`
+		(defun tier (total) (if (>= !total 100) gold (tier-low !total)))
+		(defun tier-low (total) (if (>= !total 10) silver bronze))
+		(tier !order.total)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcs := FunctionMap{}
+	for _, m := range []FunctionMap{ComparisonFunctions, StandartLogicFunctions} {
+		for k, v := range m {
+			funcs[k] = v
+		}
+	}
+	rest, err := RegisterFunctions(&funcs, program)
+	if err != nil || len(rest) != 1 {
+		t.Fatalf("RegisterFunctions gives %v %v", rest, err)
+	}
+	for total, tier := range map[int64]string{150: "gold", 50: "silver", 5: "bronze"} {
+		env := Environment{"order": NewMapStatement(map[string]Statement{"total": NewIntStatement(total)})}
+		if val := EvalProgram(&funcs, &env, rest); !IsEqualStatements(val, NewStringStatement(tier)) {
+			t.Errorf("EvalProgram gives %v for %v, expected %v", val, total, tier)
+		}
+	}
+
+	var tests = []struct {
+		program string
+		err     string
+		result  Statement
+	}{
+		{`(defun discount (p) (* !p !rate)) (discount !total)`, "", NewFloatStatement(60)},
+		{`(defun fact (n) (if (<= !n 1) 1 (* !n (fact (- !n 1))))) (fact 10)`, "", NewIntStatement(3628800)},
+		{`(defun adder (n) (lambda (x) (+ !x !n))) ((adder 5) 1)`, "", NewIntStatement(6)},
+		{`(defun loop (n) (loop !n)) (loop 1)`, "", NewErrorStatement(fmt.Errorf("function `loop' call depth limit exceeded"))},
+		{`(let ((rate 2)) (defun scale (x) (* !x !rate))) (scale 3)`, "", NewIntStatement(6)},
+		{`(let* ((a 1) (b (+ !a 1))) (defun get-a () !a) (defun get-b () !b)) (+ (get-a) (get-b) !total)`, "", NewIntStatement(123)},
+		{`(defun g () !secret) (let ((secret 7)) (g))`, "", NewErrorStatement(fmt.Errorf("environment key `secret' not found"))},
+		{`(defun h (f) (f)) (let ((x 7)) (h (lambda () !x)))`, "", NewIntStatement(7)},
+		{`(defun f x 1) (f)`, "1:1: function `defun' expect list of params", Statement{}},
+		{`(defun "f" () 1)`, "1:1: function `defun' expect function name", Statement{}},
+		{`(defun let () 1)`, "1:1: function `defun' can not redefine `let'", Statement{}},
+		{`(defun and (x) !x)`, "1:1: function `defun' can not redefine `and'", Statement{}},
+		{`(defun f () 1) (defun f () 2)`, "1:16: function `defun' can not redefine `f'", Statement{}},
+		{`(let ((x 1)) (defun f () !x) !x)`, "1:30: function `let' around `defun' expect only `defun' forms", Statement{}},
+		{`(let ((x (/ 1 0))) (defun f () !x))`, "1:10: function `/' division by zero", Statement{}},
+	}
+	for _, test := range tests {
+		funcs := FunctionMap{}
+		for _, m := range []FunctionMap{ArithmeticFunctions, ComparisonFunctions, StandartLogicFunctions} {
+			for k, v := range m {
+				funcs[k] = v
+			}
+		}
+		program, err := ParseProgram(test.program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, err := RegisterFunctions(&funcs, program)
+		if err != nil || test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("RegisterFunctions \"%v\" gives error %v, expected %v", test.program, err, test.err)
+			}
+			continue
+		}
+		env := Environment{"rate": NewFloatStatement(0.5), "total": NewIntStatement(120)}
+		if val := EvalProgram(&funcs, &env, rest); !IsEqualStatements(val, test.result) {
+			t.Errorf("EvalProgram \"%v\" gives \"%v\", expected \"%v\"", test.program, val, test.result)
+		}
+	}
+	if _, ok := StandartLogicFunctions["discount"]; ok {
+		t.Errorf("RegisterFunctions changed StandartLogicFunctions")
+	}
+}
+
+func TestMacro(t *testing.T) {
+	funcs := FunctionMap{}
+	for _, m := range []FunctionMap{ArithmeticFunctions, ComparisonFunctions, StandartLogicFunctions, ListFunctions} {
+		for k, v := range m {
+			funcs[k] = v
+		}
+	}
+	program, err := ParseProgram(`
+		(defmacro within-range (x lo hi) ` + "`" + `(and (>= ,x ,lo) (<= ,x ,hi)))
+		(defmacro any-of (x &rest ys)
+			(if (= (len !ys) 0) false ` + "`" + `(or (= ,x ,(first !ys)) (any-of ,x ,@(rest !ys)))))
+		(defmacro twice (x) ` + "`" + `(let ((tmp ,x)) (+ !tmp !tmp)))
+		(defmacro unless-zero (x body) ` + "`" + `(if (= ,x 0) 0 ,body))
+		(defmacro tagged (x) ` + "`" + `(let ((tmp ,x)) (list tmp !tmp '(tmp))))
+		(defmacro with-rate (x) ` + "`" + `(* ,x !rate))
+		(and (within-range !age 18 65) (any-of !color red green))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	macros := MacroMap{}
+	forms, err := ExpandProgram(&funcs, macros, program)
+	if err != nil || len(forms) != 1 || len(macros) != 6 {
+		t.Fatalf("ExpandProgram gives %v %v", forms, err)
+	}
+	expected := "(and (and (>= !age 18) (<= !age 65)) (or (= !color red) (or (= !color green) false)))"
+	if x := Format(forms[0]); x != expected {
+		t.Errorf("ExpandProgram gives %v, expected %v", x, expected)
+	}
+	env := Environment{"age": NewIntStatement(30), "color": NewStringStatement("green"), "tmp": NewIntStatement(100)}
+	if val := EvalProgram(&funcs, &env, forms); !IsEqualStatements(val, NewBoolStatement(true)) {
+		t.Errorf("EvalProgram gives %v", val)
+	}
+	var tests = []struct {
+		program string
+		expand  string
+		result  Statement
+	}{
+		{`(twice (+ !tmp 1))`, "(let ((tmp#1 (+ !tmp 1))) (+ !tmp#1 !tmp#1))", NewIntStatement(202)},
+		{`(twice (twice 1))`, "(let ((tmp#1 (let ((tmp#2 1)) (+ !tmp#2 !tmp#2)))) (+ !tmp#1 !tmp#1))", NewIntStatement(4)},
+		{`(let ((any-of 1)) (unless-zero !any-of (any-of 1 1)))`, "(let ((any-of 1)) (if (= !any-of 0) 0 (or (= 1 1) false)))",
+			NewBoolStatement(true)},
+		{`(tagged 5)`, "(let ((tmp#1 5)) (list tmp !tmp#1 '(tmp)))", NewListStatement([]Statement{
+			NewStringStatement("tmp"), NewIntStatement(5), *mustParse(t, "(tmp)")})},
+		// free reference of template is captured by `let' around the macro call
+		{`(let ((rate 10)) (with-rate 2))`, "(let ((rate 10)) (* 2 !rate))", NewIntStatement(20)},
+		{`(quote (any-of 1 2))`, "'(any-of 1 2)", NewExpressionStatement([]Statement{
+			NewStringStatement("any-of"), NewIntStatement(1), NewIntStatement(2)})},
+		{"`(1 ,(+ 1 1) ,@(list 3 4) '5)", "`(1 ,(+ 1 1) ,@(list 3 4) '5)",
+			*mustParse(t, `(1 2 3 4 (quote 5))`)},
+		{"`(a ,@1)", "`(a ,@1)",
+			NewErrorStatement(fmt.Errorf("function `unquote-splicing' expect list param"))},
+		{`(unquote x)`, ",x", NewErrorStatement(fmt.Errorf("function `unquote' is allowed only inside quasiquote"))},
+		{`(defmacro m () 1)`, "(defmacro m () 1)",
+			NewErrorStatement(fmt.Errorf("function `defmacro' is allowed only at top level, see ExpandProgram"))},
+	}
+	for _, test := range tests {
+		stm, err := MacroExpand(&funcs, macros, *mustParse(t, test.program))
+		if err != nil || Format(stm) != test.expand {
+			t.Errorf("MacroExpand \"%v\" gives \"%v\" (%v), expected \"%v\"", test.program, stm, err, test.expand)
+			continue
+		}
+		if val := Eval(&funcs, &env, &stm); !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(macro) \"%v\" gives \"%v\", expected \"%v\"", test.program, val, test.result)
+		}
+	}
+	var errs = []struct {
+		program string
+		err     string
+	}{
+		{`(within-range 1 2)`, "1:1: macro `within-range' required 3 param"},
+		{`(f (any-of))`, "1:4: macro `any-of' required at least 1 param"},
+		{`(within-range (+ 1 "a") 1 2)`, ""},
+		{`(twice)`, "1:1: macro `twice' required 1 param"},
+	}
+	for _, test := range errs {
+		_, err := MacroExpand(&funcs, macros, *mustParse(t, test.program))
+		if (err == nil) != (test.err == "") || err != nil && err.Error() != test.err {
+			t.Errorf("MacroExpand \"%v\" gives error \"%v\", expected \"%v\"", test.program, err, test.err)
+		}
+	}
+	loop, _ := ParseProgram("(defmacro loop (x) `(loop ,x)) (loop 1)")
+	if _, err := ExpandProgram(&funcs, MacroMap{}, loop); !errors.Is(err, ErrorExpandDepth) {
+		t.Errorf("ExpandProgram gives error %v, expected ErrorExpandDepth", err)
+	}
+	for _, src := range []string{"(defmacro m)", "(defmacro let () 1)", "(defmacro m (&rest) 1)", "(defmacro m (a &rest b c) 1)"} {
+		form := *mustParse(t, src)
+		if err := (MacroMap{}).Define(form); err == nil {
+			t.Errorf("Define \"%v\" gives no error", src)
+		}
+	}
+}
+
+func mustParse(t *testing.T, program string) *Statement {
+	t.Helper()
+	ast, err := Parse(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ast
+}
+
+func TestEvalTimeFunctions(t *testing.T) {
+	now := time.Date(2024, 5, 17, 10, 30, 0, 0, time.UTC)
+	funcs := NewTimeFunctions(func() time.Time { return now })
+	for k, v := range ComparisonFunctions {
+		funcs[k] = v
+	}
+	env := Environment{
+		"opened": NewTimeStatement(time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)),
+		"ttl":    NewDurationStatement(90 * time.Minute),
+	}
+	var tests = []struct {
+		program string
+		result  Statement
+	}{
+		{`2024-01-31T12:00:00Z`, env["opened"]},
+		{`2024-01-31T15:00:00+03:00`, env["opened"]},
+		{`2024-01-31`, NewTimeStatement(time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC))},
+		{`1h30m`, env["ttl"]},
+		{`"1h30m"`, NewStringStatement("1h30m")},
+		{`(now)`, NewTimeStatement(now)},
+		{`(date-diff (now) !opened)`, NewDurationStatement(now.Sub(env["opened"].ValueTime()))},
+		{`(date-diff (now) !opened days)`, NewIntStatement(106)},
+		{`(date-diff !opened (now) hours)`, NewIntStatement(-2566)},
+		{`(> (date-diff (now) !opened days) 90)`, NewBoolStatement(true)},
+		{`(> (date-diff (now) !opened) (days 90))`, NewBoolStatement(true)},
+		{`(date-diff (now) !opened weeks)`, NewErrorStatement(fmt.Errorf("function `date-diff' unknown unit `weeks'"))},
+		{`(add-duration !opened !ttl 30m)`, NewTimeStatement(time.Date(2024, 1, 31, 14, 0, 0, 0, time.UTC))},
+		{`(add-duration !opened 1)`, NewErrorStatement(fmt.Errorf("function `add-duration' expect duration param"))},
+		{`(before? !opened (now))`, NewBoolStatement(true)},
+		{`(after? !opened (now))`, NewBoolStatement(false)},
+		{`(< !opened 2024-02-01)`, NewBoolStatement(true)},
+		{`(weekday !opened)`, NewStringStatement("Wednesday")},
+		{`(hour (in-zone !opened +03:00))`, NewIntStatement(15)},
+		{`(hour (in-zone !opened UTC))`, NewIntStatement(12)},
+		{`(in-zone !opened Mars/Base)`, NewErrorStatement(fmt.Errorf("function `in-zone' unknown time zone Mars/Base"))},
+		{`(days 9223372036854775807)`, NewErrorStatement(fmt.Errorf("function `days' integer overflow"))},
+	}
+	for _, test := range tests {
+		ast, _ := Parse(test.program)
+		val := Eval(&funcs, &env, &ast)
+		if !IsEqualStatements(val, test.result) {
+			t.Errorf("Eval(time) \"%v\" gives \"%#v\", expected \"%#v\"",
+				test.program, val, test.result)
+		}
+	}
+	for _, s := range []Statement{env["opened"], env["ttl"], NewTimeStatement(now.In(time.FixedZone("", 3600)))} {
+		if again, err := Parse(Format(s)); err != nil || !IsEqualStatements(again, s) {
+			t.Errorf("Parse(Format) \"%v\" gives \"%#v\" (%v)", Format(s), again, err)
+		}
+	}
+}
+
+func TestZoneCache(t *testing.T) {
+	loc1, _ := loadZone("Europe/Moscow")
+	if loc, _ := loadZone("Europe/Moscow"); loc != loc1 {
+		t.Errorf("zone cache does not keep loaded zone")
+	}
+	if _, err := loadZone("Mars/Base"); err == nil {
+		t.Errorf("zone cache loads unknown zone")
+	}
+	if _, ok := zoneCache.zones["Mars/Base"]; ok {
+		t.Errorf("zone cache keeps unknown zone")
+	}
+}
+
+func TestJsonTime(t *testing.T) {
+	inp := map[string]interface{}{
+		"opened": "2024-01-31T12:00:00Z",
+		"born":   "1990-05-01",
+		"bad":    "yesterday",
+		"name":   "2024-01-31",
+		"events": []interface{}{map[string]interface{}{"at": "2024-02-01"}},
+	}
+	opts := JsonOptions{Objects: JsonMap, Schema: map[string]JsonObjectKind{
+		"opened": JsonTime, "born": JsonTime, "bad": JsonTime, "events.at": JsonTime}}
+	env := JsonMapToEnvironmentWithOptions(inp, opts)
+	out := Environment{
+		"opened": NewTimeStatement(time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)),
+		"born":   NewTimeStatement(time.Date(1990, 5, 1, 0, 0, 0, 0, time.UTC)),
+		"bad":    NewErrorStatement(fmt.Errorf("environment key `bad' is not a time: yesterday")),
+		"name":   NewStringStatement("2024-01-31"),
+		"events": NewListStatement([]Statement{NewMapStatement(map[string]Statement{
+			"at": NewTimeStatement(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC))})}),
+	}
+	if !IsEqualStatements(NewMapStatement(env), NewMapStatement(out)) {
+		t.Errorf("JsonMapToEnvironment gives \"%v\", expected \"%v\"", env, out)
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	var parse = []struct {
+		inp, outp string
+		ok        bool
+	}{
+		{"12.50", "12.50", true},
+		{"-0.05", "-0.05", true},
+		{"+7", "7", true},
+		{".5", "0.5", true},
+		{"1.5e-3", "0.0015", true},
+		{"1.5E3", "1500", true},
+		{"1e2000", "", false},
+		{"--1", "", false},
+		{"1.2.3", "", false},
+		{"", "", false},
+		{"1e", "", false},
+	}
+	for _, test := range parse {
+		d, err := ParseDecimal(test.inp)
+		if (err == nil) != test.ok || test.ok && d.String() != test.outp {
+			t.Errorf("ParseDecimal \"%v\" gives \"%v\" (%v), expected \"%v\"", test.inp, d, err, test.outp)
+		}
+	}
+	var round = []struct {
+		inp   string
+		scale int32
+		mode  RoundingMode
+		outp  string
+	}{
+		{"2.345", 2, RoundHalfEven, "2.34"},
+		{"2.355", 2, RoundHalfEven, "2.36"},
+		{"2.345", 2, RoundHalfUp, "2.35"},
+		{"-2.345", 2, RoundHalfUp, "-2.35"},
+		{"2.345", 2, RoundHalfDown, "2.34"},
+		{"2.3451", 2, RoundHalfDown, "2.35"},
+		{"2.341", 2, RoundUp, "2.35"},
+		{"-2.349", 2, RoundDown, "-2.34"},
+		{"-2.341", 2, RoundFloor, "-2.35"},
+		{"-2.349", 2, RoundCeiling, "-2.34"},
+		{"1250", -2, RoundHalfEven, "1200"},
+		{"1.5", 3, RoundHalfEven, "1.5"},
+	}
+	for _, test := range round {
+		d, _ := ParseDecimal(test.inp)
+		if x := d.Round(test.scale, test.mode).String(); x != test.outp {
+			t.Errorf("Round %v %d %v gives \"%v\", expected \"%v\"", test.inp, test.scale, test.mode, x, test.outp)
+		}
+	}
+	if q, _ := NewDecimal(-200, 2).Quo(NewDecimal(3, 0), 4, RoundHalfEven); q.String() != "-0.6667" {
+		t.Errorf("Quo gives %v", q)
+	}
+	if _, err := NewDecimal(1, 0).Quo(NewDecimal(0, 2), 4, RoundHalfEven); err == nil {
+		t.Errorf("Quo by zero gives no error")
+	}
+	if m, _ := NewDecimal(-75, 1).Mod(NewDecimal(2, 0)); m.String() != "0.5" {
+		t.Errorf("Mod gives %v", m)
+	}
+	if NewDecimal(150, 2).Cmp(NewDecimal(15, 1)) != 0 || NewDecimal(-1, 0).Cmp(NewDecimal(1, 3)) >= 0 {
+		t.Errorf("Cmp does not compare by value")
+	}
+	if mode, err := ParseRoundingMode("ceiling"); err != nil || mode != RoundCeiling {
+		t.Errorf("ParseRoundingMode gives %v %v", mode, err)
+	}
+}
+
+func TestEvalDecimalArithmetic(t *testing.T) {
+	dec := func(s string) Statement {
+		d, err := ParseDecimal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewDecimalStatement(d)
+	}
+	funcs := NewArithmeticFunctions(DecimalContext{Scale: 4, Mode: RoundHalfUp})
+	for k, v := range ComparisonFunctions {
+		funcs[k] = v
+	}
+	var tests = []struct {
+		program string
+		env     Environment
+		result  Statement
+	}{
+		{"12.50d", nil, dec("12.50")},
+		{"(= (+ 0.1d 0.2d) 0.3d)", nil, NewBoolStatement(true)},
+		{"(+ 0.1d 0.2d 1)", nil, dec("1.3")},
+		{"(* 19.99d 3)", nil, dec("59.97")},
+		{"(- 10d)", nil, dec("-10")},
+		{"(/ 2d 3)", nil, dec("0.6667")},
+		{"(/ 1d 0)", nil, NewErrorStatement(fmt.Errorf("function `/' division by zero"))},
+		{"(mod 7.5d 2)", nil, dec("1.5")},
+		{"(min 3 2.50d)", nil, dec("2.50")},
+		{"(abs -1.25d)", nil, dec("1.25")},
+		{"(round 2.345d 2)", nil, dec("2.35")},
+		{"(round 2.345d 2 half-even)", nil, dec("2.34")},
+		{"(round 2.345d 2 sideways)", nil, NewErrorStatement(fmt.Errorf("function `round' unknown rounding mode `sideways'"))},
+		{"(round 2.5 0 half-up)", nil, NewErrorStatement(fmt.Errorf("function `round' expect decimal param and mode name"))},
+		{"(+ 0.1d 0.2)", nil, NewErrorStatement(fmt.Errorf("function `+' can not mix decimal and float params"))},
+		{"(< 0.1d 0.1 0.11d)", nil, NewBoolStatement(true)},
+		{"(= 2.50d 2.5d 2.5 !x)", Environment{"x": dec("2.5")}, NewBoolStatement(true)},
+		{"(> !limit (* !price !qty))", Environment{"limit": dec("100.00"), "price": dec("33.34"), "qty": NewIntStatement(3)},
+			NewBoolStatement(false)},
+	}
+	for _, test := range tests {
+		ast, _ := Parse(test.program)
+		val := Eval(&funcs, &test.env, &ast)
+		if !IsEqualStatements(val, test.result) || val.Type() == STDecimal && Format(val) != Format(test.result) {
+			t.Errorf("Eval(decimal) \"%v\" gives \"%v\", expected \"%v\"",
+				test.program, val, test.result)
+		}
+	}
+	for program, result := range map[string]string{"(round 2.5)": "3", "(round -2.5)": "-3", "(round 2.5d)": "2d",
+		"(round 3.5d)": "4d"} {
+		ast, _ := Parse(program)
+		if x := Format(Eval(&ArithmeticFunctions, &Environment{}, &ast)); x != result {
+			t.Errorf("Eval(round) \"%v\" gives \"%v\", expected \"%v\"", program, x, result)
+		}
+	}
+	if x := Format(dec("-0.050")); x != "-0.050d" {
+		t.Errorf("Format decimal gives %v", x)
+	}
+	var inp map[string]interface{}
+	jdec := json.NewDecoder(strings.NewReader(`{"price": 19.99, "qty": 3, "big": 12345678901234567890.12}`))
+	jdec.UseNumber()
+	if err := jdec.Decode(&inp); err != nil {
+		t.Fatal(err)
+	}
+	inp["f"] = 0.1
+	env := JsonMapToEnvironmentWithOptions(inp, JsonOptions{Decimal: true})
+	out := Environment{"price": dec("19.99"), "qty": NewIntStatement(3), "big": dec("12345678901234567890.12"), "f": dec("0.1")}
+	if !IsEqualStatements(NewMapStatement(env), NewMapStatement(out)) {
+		t.Errorf("JsonMapToEnvironment decimal gives \"%v\", expected \"%v\"", env, out)
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	var tests = []struct {
+		inp  string
+		opts ParseOptions
+		outp Statement
+	}{
+		{"3000000000", ParseOptions{}, NewIntStatement(3000000000)},
+		{"-9223372036854775808", ParseOptions{}, NewIntStatement(math.MinInt64)},
+		{"9223372036854775808", ParseOptions{}, NewFloatStatement(9223372036854775808)},
+		{"1234567.891", ParseOptions{}, NewFloatStatement(1234567.891)},
+		{"1234567.891", ParseOptions{Float64: true}, NewFloat64Statement(1234567.891)},
+		{"0.1", ParseOptions{Float64: true}, NewFloat64Statement(0.1)},
+		{"nil", ParseOptions{}, NewNilStatement()},
+		{`"nil"`, ParseOptions{}, NewQuotedStringStatement("nil")},
+	}
+	for _, test := range tests {
+		ast, err := ParseWithOptions(test.inp, test.opts)
+		if err != nil || !reflect.DeepEqual(clearPos(ast), test.outp) {
+			t.Errorf("Parse %+v \"%v\" gives \"%#v\" (%v), expected \"%#v\"", test.opts, test.inp, ast, err, test.outp)
+		}
+	}
+	forms, _ := ParseProgramWithOptions("(f 0.1) 2.5", ParseOptions{Float64: true})
+	if len(forms) != 2 || !forms[1].IsFloat64() || !forms[0].ValueExpression()[1].IsFloat64() {
+		t.Errorf("ParseProgram float64 gives \"%#v\"", forms)
+	}
+	dec := NewDecoder(strings.NewReader("0.1 [0.5] {a:0.5}"))
+	dec.UseFloat64()
+	if stm, _ := dec.Decode(); stm.Value != float64(0.1) {
+		t.Errorf("Decoder float64 gives \"%#v\"", stm)
+	}
+	if again, _ := ParseWithOptions(Format(NewFloat64Statement(0.1)), ParseOptions{Float64: true}); again.Value != 0.1 {
+		t.Errorf("Parse(Format(float64)) gives \"%#v\"", again)
+	}
+	var equal = []struct {
+		s1, s2 Statement
+		eq     bool
+	}{
+		{NewFloatStatement(0.1), NewFloat64Statement(0.1), true},
+		{NewFloat64Statement(0.1), NewFloat64Statement(0.1 + 1e-12), false},
+		{NewFloatStatement(0.1), NewFloat64Statement(0.1 + 1e-12), true},
+		{NewIntStatement(1 << 40), NewIntStatement(1<<40 + 1), false},
+	}
+	for _, test := range equal {
+		if IsEqualStatements(test.s1, test.s2) != test.eq {
+			t.Errorf("IsEqualStatements \"%#v\" \"%#v\" is not %v", test.s1, test.s2, test.eq)
+		}
+	}
+}
+
+func TestJsonOptions(t *testing.T) {
+	var inp map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(`{"id": 3000000000, "amount": 1234567.891, "n": 10, "s": "x"}`))
+	dec.UseNumber()
+	if err := dec.Decode(&inp); err != nil {
+		t.Fatal(err)
+	}
+	inp["go"] = 7
+	var tests = []struct {
+		opts JsonOptions
+		outp Environment
+	}{
+		{JsonOptions{}, Environment{
+			"id":     NewIntStatement(3000000000),
+			"amount": NewFloatStatement(1234567.891),
+			"n":      NewIntStatement(10),
+			"s":      NewStringStatement("x"),
+			"go":     NewIntStatement(7),
+		}},
+		{JsonOptions{Float64: true}, Environment{
+			"id":     NewIntStatement(3000000000),
+			"amount": NewFloat64Statement(1234567.891),
+			"n":      NewIntStatement(10),
+			"s":      NewStringStatement("x"),
+			"go":     NewIntStatement(7),
+		}},
+	}
+	for _, test := range tests {
+		if env := JsonMapToEnvironmentWithOptions(inp, test.opts); !reflect.DeepEqual(env, test.outp) {
+			t.Errorf("JsonMapToEnvironment %+v gives \"%#v\", expected \"%#v\"", test.opts, env, test.outp)
+		}
+	}
+	env := JsonMapToEnvironmentWithOptions(map[string]interface{}{"a": 0.25}, JsonOptions{Float64: true})
+	if env["a"].Value != 0.25 {
+		t.Errorf("JsonMapToEnvironment float64 gives \"%#v\"", env)
+	}
+	inp = nil
+	if err := json.Unmarshal([]byte(`{"id": 3000000001, "max": 9007199254740993, "half": 2.5}`), &inp); err != nil {
+		t.Fatal(err)
+	}
+	out := Environment{"id": NewIntStatement(3000000001),
+		"max": NewFloatStatement(9007199254740992), "half": NewFloatStatement(2.5)}
+	if env := JsonMapToEnvironment(inp); !reflect.DeepEqual(env, out) {
+		t.Errorf("JsonMapToEnvironment of json.Unmarshal gives \"%v\", expected \"%v\"", env, out)
+	}
+}
+
+func TestEvalFuzzyLogic(t *testing.T) {
+	var tests = []struct {
+		program string
+		funcs   FunctionMap
+		env     Environment
+		result  Statement
+	}{
+		{"(fand (env a) (env b))",
+			FuzzyLogicFunctions,
+			Environment{"a": NewFloatStatement(1.0), "b": NewFloatStatement(1.0)},
+			NewFloatStatement(1.0),
+		},
+		{"(fand (env a) (env b))",
+			FuzzyLogicFunctions,
+			Environment{"a": NewFloatStatement(0.9), "b": NewFloatStatement(0.5)},
+			NewFloatStatement(0.5),
+		},
+		{"(for (env a) (env b) (env c))",
 			FuzzyLogicFunctions,
 			Environment{"a": NewFloatStatement(0.9), "b": NewFloatStatement(0.8), "c": NewFloatStatement(0.7)},
 			NewFloatStatement(0.9),
@@ -278,11 +2127,31 @@ func TestEvalFuzzyLogic(t *testing.T) {
 			Environment{"a": NewFloatStatement(0.1), "b": NewErrorStatement(fmt.Errorf("Wow!"))},
 			NewErrorStatement(fmt.Errorf("Wow!")),
 		},
+		{"(fand !a !b)",
+			FuzzyLogicFunctions,
+			Environment{"a": NewFloat64Statement(0.3), "b": NewFloatStatement(0.7)},
+			NewFloat64Statement(0.3),
+		},
+		{"(fnot !a)",
+			FuzzyLogicFunctions,
+			Environment{"a": NewFloat64Statement(0.25)},
+			NewFloat64Statement(0.75),
+		},
+		{"(for !a? !b)",
+			FuzzyLogicFunctions,
+			Environment{"b": NewFloatStatement(0.25)},
+			NewFloatStatement(0.25),
+		},
+		{"(fnot nil)",
+			FuzzyLogicFunctions,
+			Environment{},
+			NewFloatStatement(1.0),
+		},
 	}
 	for _, test := range tests {
 		ast, _ := Parse(test.program)
 		val := Eval(&test.funcs, &test.env, &ast)
-		if !IsEqualStatements(val, test.result) {
+		if !IsEqualStatements(val, test.result) || val.IsFloat64() != test.result.IsFloat64() {
 			t.Errorf("Eval(fuzzy logic) \"%v\" gives \"%#v\", expected \"%#v\"",
 				test.program, val, test.result)
 		}
@@ -320,7 +2189,6 @@ func TestFuzzyEq(t *testing.T) {
 	}
 }
 
-/*
 func TestJson2Env(t *testing.T) {
 	inp := map[string]interface{}{
 		"a": "abc",
@@ -331,18 +2199,22 @@ func TestJson2Env(t *testing.T) {
 			"x": 0.1,
 			"y": 0.9,
 		},
-		"f": nil, //skipped
+		"f": nil,
 		"g": []interface{}{1, 2, 3, "u"},
 	}
 	out := Environment{
 		"a": NewStringStatement("abc"),
 		"b": NewBoolStatement(true),
 		"c": NewIntStatement(10),
-		"d": NewFloatStatement(5.0),
+		"d": NewIntStatement(5),
 		"e": NewFuzzyStatement(NewFuzzySet(false,
 			FuzzyElement{NewStringStatement("x"), 0.1},
 			FuzzyElement{NewStringStatement("y"), 0.9},
 		)),
+		"f": NewNilStatement(),
+		"g": NewListStatement([]Statement{
+			NewIntStatement(1), NewIntStatement(2), NewIntStatement(3), NewStringStatement("u"),
+		}),
 	}
 	env := JsonMapToEnvironment(inp)
 	for k, v1 := range env {
@@ -357,7 +2229,6 @@ func TestJson2Env(t *testing.T) {
 		}
 	}
 }
-*/
 
 func sliceEq(a, b []float32) bool {
 	if (a == nil) != (b == nil) {
@@ -0,0 +1,165 @@
+package microlisp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Time functions with the system clock
+var TimeFunctions = NewTimeFunctions(time.Now)
+
+// Time functions with clock now, which is called by (now)
+func NewTimeFunctions(now func() time.Time) FunctionMap {
+	return FunctionMap{
+		"now": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			if len(expr) != 0 {
+				return NewErrorStatement(fmt.Errorf("function `now' required no param"))
+			}
+			return NewTimeStatement(now())
+		},
+		// (date-diff t1 t2) gives duration t1 - t2,
+		// (date-diff t1 t2 unit) gives whole number of days, hours, minutes or seconds
+		"date-diff": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			args, errStm := stringParams("date-diff", funcs, env, expr, 2, STTime, STTime, STString)
+			if errStm != nil {
+				return *errStm
+			}
+			d := args[0].ValueTime().Sub(args[1].ValueTime())
+			if len(args) == 2 {
+				return NewDurationStatement(d)
+			}
+			unit, ok := timeUnits[args[2].ValueString()]
+			if !ok {
+				return NewErrorStatement(fmt.Errorf("function `date-diff' unknown unit `%s'", args[2].ValueString()))
+			}
+			return NewIntStatement(int64(d / unit))
+		},
+		// (add-duration t d...) gives t moved by durations
+		"add-duration": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			if len(expr) < 2 {
+				return NewErrorStatement(fmt.Errorf("function `add-duration' required at least 2 param"))
+			}
+			types := []StatementType{STTime}
+			for range expr[1:] {
+				types = append(types, STDuration)
+			}
+			args, errStm := stringParams("add-duration", funcs, env, expr, len(types), types...)
+			if errStm != nil {
+				return *errStm
+			}
+			t := args[0].ValueTime()
+			for _, d := range args[1:] {
+				t = t.Add(d.ValueDuration())
+			}
+			return NewTimeStatement(t)
+		},
+		"before?": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			args, errStm := stringParams("before?", funcs, env, expr, 2, STTime, STTime)
+			if errStm != nil {
+				return *errStm
+			}
+			return NewBoolStatement(args[0].ValueTime().Before(args[1].ValueTime()))
+		},
+		"after?": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			args, errStm := stringParams("after?", funcs, env, expr, 2, STTime, STTime)
+			if errStm != nil {
+				return *errStm
+			}
+			return NewBoolStatement(args[0].ValueTime().After(args[1].ValueTime()))
+		},
+		// English name of the day: Monday, Tuesday...
+		"weekday": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			args, errStm := stringParams("weekday", funcs, env, expr, 1, STTime)
+			if errStm != nil {
+				return *errStm
+			}
+			return NewStringStatement(args[0].ValueTime().Weekday().String())
+		},
+		"hour": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			args, errStm := stringParams("hour", funcs, env, expr, 1, STTime)
+			if errStm != nil {
+				return *errStm
+			}
+			return NewIntStatement(int64(args[0].ValueTime().Hour()))
+		},
+		// (in-zone t zone), zone is IANA name like Europe/Moscow, UTC, Local or offset like +03:00
+		"in-zone": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			args, errStm := stringParams("in-zone", funcs, env, expr, 2, STTime, STString)
+			if errStm != nil {
+				return *errStm
+			}
+			loc, err := loadZone(args[1].ValueString())
+			if err != nil {
+				return NewErrorStatement(fmt.Errorf("function `in-zone' %w", err))
+			}
+			return NewTimeStatement(args[0].ValueTime().In(loc))
+		},
+		// (days n) gives duration of n days of 24 hours
+		"days": func(funcs *FunctionMap, env *Environment, expr []Statement) Statement {
+			args, errStm := stringParams("days", funcs, env, expr, 1, STInt)
+			if errStm != nil {
+				return *errStm
+			}
+			n := args[0].ValueInt()
+			if n > maxDays || n < -maxDays {
+				return NewErrorStatement(fmt.Errorf("function `days' %w", errIntegerOverflow))
+			}
+			return NewDurationStatement(time.Duration(n) * 24 * time.Hour)
+		},
+	}
+}
+
+const maxDays = int64(1<<63-1) / int64(24*time.Hour)
+
+var timeUnits = map[string]time.Duration{
+	"days":    24 * time.Hour,
+	"hours":   time.Hour,
+	"minutes": time.Minute,
+	"seconds": time.Second,
+}
+
+// Loaded zones by name, only known zones are cached so the map stays small
+var zoneCache = struct {
+	mu    sync.Mutex
+	zones map[string]*time.Location
+}{zones: make(map[string]*time.Location)}
+
+func loadZone(name string) (*time.Location, error) {
+	zoneCache.mu.Lock()
+	defer zoneCache.mu.Unlock()
+	if loc, ok := zoneCache.zones[name]; ok {
+		return loc, nil
+	}
+	var loc *time.Location
+	if t, err := time.Parse("-07:00", name); err == nil {
+		_, offset := t.Zone()
+		loc = time.FixedZone(name, offset)
+	} else if loc, err = time.LoadLocation(name); err != nil {
+		return nil, err
+	}
+	zoneCache.zones[name] = loc
+	return loc, nil
+}
+
+// Time in RFC 3339 format or date only (2006-01-02, UTC)
+func parseTimeLiteral(s string) (time.Time, bool) {
+	if len(s) < len("2006-01-02") || s[4] != '-' {
+		return time.Time{}, false
+	}
+	if len(s) == len("2006-01-02") {
+		t, err := time.Parse(time.DateOnly, s)
+		return t, err == nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
+
+// Duration in time.ParseDuration format: 90m, 1h30m, -1.5s
+func parseDurationLiteral(s string) (time.Duration, bool) {
+	if s == "" || s[len(s)-1] < 'a' || s[len(s)-1] > 'z' {
+		return 0, false
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil
+}